@@ -2,17 +2,12 @@ package cmd
 
 import (
 	"encoding/json"
-	"fmt"
-	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"log"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
 var ViperPrefix = ""
-var LogFile *os.File
 
 func ViperKey(name string) string {
 	return ViperPrefix + strings.ReplaceAll(name, "-", "_")
@@ -40,45 +35,10 @@ func OptionString(name, flag, defaultValue, description string) {
 	viper.BindPFlag(ViperKey(name), rootCmd.PersistentFlags().Lookup(name))
 }
 
-func OpenLog() {
-	filename := viper.GetString("logfile")
-	LogFile = nil
-	if filename == "stdout" || filename == "-" {
-		log.SetOutput(os.Stdout)
-	} else if filename == "stderr" {
-		log.SetOutput(os.Stderr)
-	} else {
-		fp, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
-		if err != nil {
-			log.Fatalf("failed opening log file: %v", err)
-		}
-		LogFile = fp
-		log.SetOutput(LogFile)
-	}
-
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmsgprefix)
-	if viper.GetBool("debug") {
-		log.SetFlags(log.Flags() | log.Lshortfile)
-	}
-
-	_, name := filepath.Split(os.Args[0])
-	prefix := fmt.Sprintf("%s[%d] ", name, os.Getpid())
-	log.SetPrefix(prefix)
-
-}
-
-func CloseLog() {
-	if LogFile != nil {
-		err := LogFile.Close()
-		cobra.CheckErr(err)
-		LogFile = nil
-	}
-}
-
 func FormatJSON(v any) string {
 	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		log.Fatalf("failed formatting JSON: %v", err)
+		Fatal("failed formatting JSON", "error", err)
 	}
 	return string(data)
 }
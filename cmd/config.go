@@ -0,0 +1,550 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigKey describes a configuration setting; the type of Default is the
+// type the value must parse as, and Unset keys get no viper default
+type ConfigKey struct {
+	Name    string
+	Default any
+	Help    string
+	Unset   bool
+	Secret  bool
+}
+
+// REDACTED replaces secret values in config show output
+const REDACTED = "<redacted>"
+
+var CONFIG_KEYS = []ConfigKey{
+	{Name: "logfile", Default: "stderr", Help: "log target (stderr, stdout, syslog, journald, or a filename)"},
+	{Name: "log_level", Default: DEFAULT_LOG_LEVEL, Help: "log level (debug, info, warn, error)"},
+	{Name: "log_format", Default: DEFAULT_LOG_FORMAT, Help: "log format (text, json)"},
+	{Name: "log_max_size_mb", Default: 0, Help: "rotate the log file at this size (0 disables)"},
+	{Name: "log_rotate_hours", Default: 0, Help: "rotate the log file at this interval (0 disables)"},
+	{Name: "log_max_age_days", Default: 0, Help: "remove rotated log files older than this, without rotating (0 disables)"},
+	{Name: "log_max_backups", Default: 0, Help: "rotated log files to keep (0 keeps all)"},
+	{Name: "log_compress", Default: false, Help: "gzip rotated log files"},
+	{Name: "syslog_facility", Default: DEFAULT_SYSLOG_FACILITY, Help: "syslog facility"},
+	{Name: "syslog_tag", Default: "", Help: "syslog and journald identifier (default is the program name)"},
+	{Name: "debug", Default: false, Help: "produce debug output"},
+	{Name: "verbose", Default: false, Help: "increase verbosity"},
+	{Name: "foreground", Default: false, Help: "do not daemonize"},
+	{Name: "systemd", Default: false, Help: "run in the foreground as a systemd notify service"},
+	{Name: "pidfile", Default: DEFAULT_PIDFILE, Help: "daemon pid file"},
+	{Name: "domain", Default: "", Help: "mail domain (default is the domain of the host name)", Unset: true},
+	{Name: "usernames", Default: "", Help: "comma separated users to watch (default is users from /etc/passwd)"},
+	{Name: "skip_users", Default: DEFAULT_SKIP_USERS, Help: "comma separated users never watched"},
+	{Name: "min_uid", Default: DEFAULT_MIN_UID, Help: "lowest uid watched from /etc/passwd"},
+	{Name: "scan_interval_seconds", Default: DEFAULT_SCAN_SECONDS, Help: "seconds between sieve_trace directory scans"},
+	{Name: "stabilize_interval_seconds", Default: DEFAULT_STABILIZE_SECONDS, Help: "seconds between stability checks"},
+	{Name: "stabilize_count", Default: DEFAULT_STABILIZE_COUNT, Help: "unchanged checks before a trace file is stable"},
+	{Name: "stabilize_strategy", Default: DEFAULT_STABILIZE_STRATEGY, Help: "stability checks (size, mtime, open, lock, combined)"},
+	{Name: "stabilize_mtime_ms", Default: DEFAULT_STABILIZE_MTIME_MS, Help: "minimum age of the last write for the mtime check"},
+	{Name: "shutdown_timeout_seconds", Default: DEFAULT_SHUTDOWN_TIMEOUT_SECONDS, Help: "seconds allowed for in-flight sends at shutdown"},
+	{Name: "delivery_workers", Default: DEFAULT_DELIVERY_WORKERS, Help: "concurrent delivery workers"},
+	{Name: "delivery_queue_size", Default: DEFAULT_DELIVERY_QUEUE_SIZE, Help: "queued deliveries per worker"},
+	{Name: "rate_limit_user_per_hour", Default: DEFAULT_RATE_LIMIT_USER_PER_HOUR, Help: "traces sent per user per hour (0 disables)"},
+	{Name: "rate_limit_user_burst", Default: DEFAULT_RATE_LIMIT_USER_BURST, Help: "traces a user may send at once"},
+	{Name: "rate_limit_global_per_hour", Default: DEFAULT_RATE_LIMIT_GLOBAL_PER_HOUR, Help: "traces sent per hour for all users (0 disables)"},
+	{Name: "rate_limit_global_burst", Default: DEFAULT_RATE_LIMIT_GLOBAL_BURST, Help: "traces all users may send at once"},
+	{Name: "digest_dir", Default: DEFAULT_DIGEST_DIR, Help: "directory holding rate limited traces"},
+	{Name: "digest_interval_minutes", Default: DEFAULT_DIGEST_INTERVAL_MINUTES, Help: "minutes between digest sends"},
+	{Name: "loop_window_minutes", Default: DEFAULT_LOOP_WINDOW_MINUTES, Help: "minutes the Message-IDs of sent traces are remembered for loop detection"},
+	{Name: "state_file", Default: DEFAULT_STATE_FILE, Help: "pending trace file state"},
+	{Name: "state_save_seconds", Default: DEFAULT_STATE_SAVE_SECONDS, Help: "seconds between state saves"},
+	{Name: "journal_file", Default: DEFAULT_JOURNAL_FILE, Help: "delivery journal"},
+	{Name: "journal_retention_hours", Default: DEFAULT_JOURNAL_RETENTION_HOURS, Help: "hours journal entries are kept"},
+	{Name: "journal_compact_hours", Default: DEFAULT_JOURNAL_COMPACT_HOURS, Help: "hours between journal compactions"},
+	{Name: "history_file", Default: DEFAULT_HISTORY_FILE, Help: "processed trace history database (empty disables)"},
+	{Name: "history_retention_days", Default: DEFAULT_HISTORY_RETENTION_DAYS, Help: "days history is kept (0 keeps all)"},
+	{Name: "http_listen", Default: "", Help: "address for the web UI, such as 127.0.0.1:8080 (empty disables)"},
+	{Name: "http_htpasswd", Default: "", Help: "htpasswd file of web UI users (bcrypt or {SHA} hashes)"},
+	{Name: "http_proxy_header", Default: "", Help: "trust this request header from a reverse proxy in http_trusted_proxies as the user name"},
+	{Name: "http_trusted_proxies", Default: DEFAULT_HTTP_TRUSTED_PROXIES, Help: "comma separated proxy addresses or networks whose http_proxy_header is trusted"},
+	{Name: "http_admins", Default: "", Help: "comma separated web UI users who can see every user's traces"},
+	{Name: "tracing_file", Default: DEFAULT_TRACING_FILE, Help: "users with tracing enabled and when it expires"},
+	{Name: "tracing_level_file", Default: "", Help: "Dovecot passwd-file userdb written with each enabled user's sieve_trace_level (empty disables)"},
+	{Name: "tracing_max_hours", Default: DEFAULT_TRACING_MAX_HOURS, Help: "hours a sieve_trace directory created by the user lasts (0 never expires)"},
+	{Name: "tracing_check_seconds", Default: DEFAULT_TRACING_CHECK_SECONDS, Help: "seconds between tracing expiry checks (0 disables)"},
+	{Name: "transport", Default: DEFAULT_TRANSPORT, Help: "how traces are delivered (sendmail, webhook)"},
+	{Name: "webhook_url", Default: "", Help: "URL trace, digest and notice events are posted to by the webhook transport"},
+	{Name: "webhook_secret", Default: "", Help: "HMAC-SHA256 key signing webhook requests (unsigned when empty)", Secret: true},
+	{Name: "webhook_link_url", Default: "", Help: "web UI address linked from webhook events instead of the raw trace"},
+	{Name: "webhook_include_raw", Default: false, Help: "include the raw trace in webhook events without a webhook_link_url"},
+	{Name: "webhook_timeout_seconds", Default: DEFAULT_WEBHOOK_TIMEOUT_SECONDS, Help: "seconds allowed for each webhook request"},
+	{Name: "webhook_retry_seconds", Default: DEFAULT_WEBHOOK_RETRY_SECONDS, Help: "seconds before a failed trace is retried, doubling after each failure up to an hour"},
+	{Name: "encryption", Default: DEFAULT_ENCRYPTION, Help: "encrypt to the user's key when present (auto, off)"},
+	{Name: "encryption_failure", Default: DEFAULT_ENCRYPTION_FAILURE, Help: "when a user's key is unusable, skip the trace or send it unencrypted (skip, plain)"},
+	{Name: "encryption_pgp_key", Default: DEFAULT_ENCRYPTION_PGP_KEY, Help: "OpenPGP public key, relative to the user's home"},
+	{Name: "encryption_smime_cert", Default: DEFAULT_ENCRYPTION_SMIME_CERT, Help: "S/MIME certificate, relative to the user's home"},
+	{Name: "dkim.selector", Default: "", Help: "DKIM selector"},
+	{Name: "dkim.domain", Default: "", Help: "DKIM signing domain (default is domain)"},
+	{Name: "dkim.key_file", Default: "", Help: "DKIM private key (signing is disabled when unset)"},
+	{Name: "dkim.domains", Default: map[string]any{}, Help: "selector and key_file by domain, used in place of the default key when the name matches domain", Unset: true},
+	{Name: "unit.executable", Default: "", Help: "program path written to the systemd unit"},
+	{Name: "unit.watchdog", Default: DEFAULT_WATCHDOG_SECONDS, Help: "systemd watchdog seconds (0 disables)"},
+}
+
+// envSettable returns false for maps, which are only settable from the
+// config file
+// secret returns true if the value must not be shown: a credential, or a
+// value read from a _FILE variable, which is how secrets are mounted
+func (k ConfigKey) secret() bool {
+	if k.Secret {
+		return true
+	}
+	if !k.envSettable() {
+		return false
+	}
+	_, found := os.LookupEnv(EnvName(k.Name) + "_FILE")
+	return found
+}
+
+func (k ConfigKey) envSettable() bool {
+	_, isMap := k.Default.(map[string]any)
+	return !isMap
+}
+
+// envPrefix returns the environment variable prefix, the program name in
+// upper case with dashes replaced
+func envPrefix() string {
+	return strings.ToUpper(strings.ReplaceAll(rootCmd.Name(), "-", "_"))
+}
+
+// EnvName returns the environment variable that sets a config key; dots
+// separating nested keys become underscores
+func EnvName(key string) string {
+	return envPrefix() + "_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// bindEnv makes every config key settable from the environment.  A
+// variable named with a _FILE suffix is read from the named file, so
+// secrets can be mounted rather than passed in the environment.
+func bindEnv() error {
+	viper.SetEnvPrefix(envPrefix())
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+	for _, key := range CONFIG_KEYS {
+		if !key.envSettable() {
+			continue
+		}
+		name := EnvName(key.Name)
+		filename, found := os.LookupEnv(name + "_FILE")
+		if found {
+			if _, set := os.LookupEnv(name); set {
+				return fmt.Errorf("both %s and %s_FILE are set", name, name)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("failed reading %s_FILE: %v", name, err)
+			}
+			// set in viper rather than the environment, so the secret is
+			// not inherited by sendmail and other child processes
+			flag := rootCmd.PersistentFlags().Lookup(strings.ReplaceAll(key.Name, "_", "-"))
+			if flag == nil || !flag.Changed {
+				viper.Set(key.Name, strings.TrimRight(string(data), "\r\n"))
+			}
+		}
+		err := viper.BindEnv(key.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setConfigDefaults registers the default of every config key with viper
+func setConfigDefaults() {
+	for _, key := range CONFIG_KEYS {
+		if !key.Unset {
+			viper.SetDefault(key.Name, key.Default)
+		}
+	}
+}
+
+func configKey(name string) (ConfigKey, bool) {
+	for _, key := range CONFIG_KEYS {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	// per-domain dkim keys are named by the domain
+	if strings.HasPrefix(name, "dkim.domains.") {
+		return ConfigKey{Name: name, Default: ""}, true
+	}
+	return ConfigKey{}, false
+}
+
+// configSource returns where the effective value of a key comes from
+func configSource(name string) string {
+	flag := rootCmd.PersistentFlags().Lookup(strings.ReplaceAll(name, "_", "-"))
+	if flag != nil && flag.Changed {
+		return "flag"
+	}
+	if _, found := os.LookupEnv(EnvName(name)); found {
+		return "env"
+	}
+	if _, found := os.LookupEnv(EnvName(name) + "_FILE"); found {
+		return "env"
+	}
+	if viper.InConfig(name) {
+		return "config"
+	}
+	if name == "domain" {
+		return "hostname"
+	}
+	return "default"
+}
+
+// ConfigSetting is an effective config value and its source
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// EffectiveConfig returns every known key and any unknown keys from the
+// config file with their merged values
+func EffectiveConfig() []ConfigSetting {
+	setConfigDefaults()
+	if viper.GetString("domain") == "" {
+		domain, err := hostnameDomain()
+		if err == nil {
+			viper.SetDefault("domain", domain)
+		}
+	}
+	settings := []ConfigSetting{}
+	seen := make(map[string]bool)
+	for _, key := range CONFIG_KEYS {
+		if key.Name == "dkim.domains" {
+			continue
+		}
+		value := viper.Get(key.Name)
+		if key.secret() && value != "" {
+			value = REDACTED
+		}
+		settings = append(settings, ConfigSetting{key.Name, value, configSource(key.Name)})
+		seen[key.Name] = true
+	}
+	keys := viper.AllKeys()
+	slices.Sort(keys)
+	for _, name := range keys {
+		if !seen[name] && viper.InConfig(name) {
+			settings = append(settings, ConfigSetting{name, viper.Get(name), "config"})
+		}
+	}
+	return settings
+}
+
+// ConfigProblem is a validation failure for one key
+type ConfigProblem struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+// ValidateConfig checks the config file keys and the effective values,
+// returning every problem found
+func ValidateConfig(filename string) []ConfigProblem {
+	problems := []ConfigProblem{}
+	add := func(key, format string, args ...any) {
+		problems = append(problems, ConfigProblem{key, fmt.Sprintf(format, args...)})
+	}
+
+	if filename != "" {
+		file := viper.New()
+		file.SetConfigFile(filename)
+		err := file.ReadInConfig()
+		if err != nil {
+			add("config", "%v", err)
+		}
+		for _, name := range file.AllKeys() {
+			key, known := configKey(name)
+			if !known {
+				add(name, "unknown key")
+				continue
+			}
+			err := checkType(key, file.Get(name))
+			if err != nil {
+				add(name, "%v", err)
+			}
+		}
+	}
+
+	setConfigDefaults()
+	_, err := logLevel()
+	if err != nil {
+		add("log_level", "%v", err)
+	}
+	if !slices.Contains([]string{"text", "json"}, viper.GetString("log_format")) {
+		add("log_format", "unknown format: %s", viper.GetString("log_format"))
+	}
+	if _, ok := SYSLOG_FACILITIES[strings.ToLower(viper.GetString("syslog_facility"))]; !ok {
+		add("syslog_facility", "unknown facility: %s", viper.GetString("syslog_facility"))
+	}
+	_, err = parseStabilizeStrategy(viper.GetString("stabilize_strategy"))
+	if err != nil {
+		add("stabilize_strategy", "%v", err)
+	}
+	switch viper.GetString("transport") {
+	case TRANSPORT_SENDMAIL:
+	case TRANSPORT_WEBHOOK:
+		_, err = NewWebhook()
+		if err != nil {
+			add("webhook_url", "%v", err)
+		}
+	default:
+		add("transport", "unknown transport: %s", viper.GetString("transport"))
+	}
+	if !slices.Contains([]string{"auto", "off"}, viper.GetString("encryption")) {
+		add("encryption", "unknown mode: %s", viper.GetString("encryption"))
+	}
+	if !slices.Contains([]string{"skip", "plain"}, viper.GetString("encryption_failure")) {
+		add("encryption_failure", "unknown policy: %s", viper.GetString("encryption_failure"))
+	}
+
+	domain := viper.GetString("domain")
+	if domain == "" {
+		domain, err = hostnameDomain()
+		if err != nil {
+			add("domain", "%v", err)
+		}
+	}
+	if domain != "" {
+		_, err = mail.ParseAddress("SIEVE-DAEMON@" + domain)
+		if err != nil {
+			add("domain", "invalid address domain %q: %v", domain, err)
+		}
+		for _, username := range strings.Split(viper.GetString("usernames"), ",") {
+			username = strings.TrimSpace(username)
+			if username == "" {
+				continue
+			}
+			_, err = mail.ParseAddress(username + "@" + domain)
+			if err != nil {
+				add("usernames", "invalid address for %q: %v", username, err)
+			}
+		}
+	}
+
+	for _, name := range []string{"state_file", "journal_file", "digest_dir", "pidfile"} {
+		dir := filepath.Dir(viper.GetString(name))
+		if !IsDir(dir) {
+			add(name, "directory does not exist: %s", dir)
+		}
+	}
+	switch logfile := viper.GetString("logfile"); logfile {
+	case "stdout", "-", "stderr", "syslog", "journald":
+	default:
+		if !IsDir(filepath.Dir(logfile)) {
+			add("logfile", "directory does not exist: %s", filepath.Dir(logfile))
+		}
+	}
+	if htpasswd := viper.GetString("http_htpasswd"); htpasswd != "" {
+		_, err = loadHtpasswd(htpasswd)
+		if err != nil {
+			add("http_htpasswd", "%v", err)
+		}
+	}
+	_, err = LoadDKIMSigner()
+	if err != nil {
+		add("dkim", "%v", err)
+	}
+	return problems
+}
+
+// checkType returns an error when value does not parse as the type of the
+// key's default
+func checkType(key ConfigKey, value any) error {
+	text := fmt.Sprint(value)
+	switch key.Default.(type) {
+	case int:
+		_, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("not an integer: %s", text)
+		}
+	case bool:
+		_, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %s", text)
+		}
+	case string:
+		if _, ok := value.(map[string]any); ok {
+			return fmt.Errorf("not a string")
+		}
+	}
+	return nil
+}
+
+// writeDefaultConfig writes a YAML config file with every key commented
+// out at its default value
+func writeDefaultConfig(w io.Writer) error {
+	fmt.Fprintf(w, "# %s configuration\n", rootCmd.Name())
+	fmt.Fprintf(w, "#\n# Each setting may also be set with the environment variable in brackets,\n")
+	fmt.Fprintf(w, "# or read from the file named by that variable with a _FILE suffix.\n")
+	group := ""
+	for _, key := range CONFIG_KEYS {
+		name := key.Name
+		indent := ""
+		prefix, child, nested := strings.Cut(key.Name, ".")
+		if nested {
+			if prefix != group {
+				fmt.Fprintf(w, "\n#%s:\n", prefix)
+			}
+			name = child
+			indent = "  "
+		}
+		group = ""
+		if nested {
+			group = prefix
+		}
+		value, err := yaml.Marshal(key.Default)
+		if err != nil {
+			return err
+		}
+		if !nested {
+			fmt.Fprintln(w)
+		}
+		if key.envSettable() {
+			fmt.Fprintf(w, "%s# %s [%s]\n", indent, key.Help, EnvName(key.Name))
+		} else {
+			fmt.Fprintf(w, "%s# %s\n", indent, key.Help)
+		}
+		fmt.Fprintf(w, "#%s%s: %s", indent, name, value)
+	}
+	return nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "show, validate or create the configuration",
+	Long: `
+Inspect the configuration merged from flags, the config file and the
+built in defaults.
+`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the log is left on stderr so a broken log configuration can
+		// still be shown and validated
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "output the effective configuration",
+	Long: `
+Output every setting with its effective value and where the value came
+from: flag, env, config, hostname or default.  Secrets, and values read
+from _FILE variables, are redacted.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		settings := EffectiveConfig()
+		if viper.GetString("config.format") == "json" {
+			fmt.Println(FormatJSON(settings))
+			return
+		}
+		for _, setting := range settings {
+			fmt.Printf("%s: %v  # %s\n", setting.Key, setting.Value, setting.Source)
+		}
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check the configuration",
+	Long: `
+Check the config file for unknown keys and values of the wrong type, and
+the effective configuration for invalid settings, addresses and missing
+directories and key files.  Exits non-zero when a problem is found.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filename := ""
+		if IsFile(cfgFile) {
+			filename = cfgFile
+		}
+		problems := ValidateConfig(filename)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	},
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init [FILE]",
+	Short: "write a default config file",
+	Long: `
+Write a config file listing every setting, commented out at its default
+value, to FILE or stdout.  An existing FILE is not overwritten.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			err := writeDefaultConfig(os.Stdout)
+			cobra.CheckErr(err)
+			return
+		}
+		file, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		cobra.CheckErr(err)
+		defer file.Close()
+		err = writeDefaultConfig(file)
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configInitCmd)
+	configShowCmd.Flags().String("format", "text", "output format (text, json)")
+	viper.BindPFlag("config.format", configShowCmd.Flags().Lookup("format"))
+}
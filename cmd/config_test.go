@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	data := "scan_interval_seconds: fast\nstabilise_count: 3\ndkim:\n  domains:\n    example.org:\n      selector: s1\n"
+	require.Nil(t, os.WriteFile(filename, []byte(data), 0600))
+	problems := map[string]string{}
+	for _, problem := range ValidateConfig(filename) {
+		problems[problem.Key] = problem.Message
+	}
+	require.Equal(t, "not an integer: fast", problems["scan_interval_seconds"])
+	require.Equal(t, "unknown key", problems["stabilise_count"])
+	require.NotContains(t, problems, "dkim.domains.example.org.selector")
+	require.NotContains(t, problems, "log_level")
+}
+
+func TestWriteDefaultConfig(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, writeDefaultConfig(&buf))
+	// uncommenting every setting yields a file with no problems of its own
+	uncomment := regexp.MustCompile(`(?m)^#(\s*[a-z_]+:)`)
+	config := uncomment.ReplaceAllString(buf.String(), "$1")
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(filename, []byte(config), 0600))
+	for _, problem := range ValidateConfig(filename) {
+		require.False(t, strings.Contains(problem.Message, "unknown key") || strings.HasPrefix(problem.Message, "not a"), problem.String())
+	}
+	for _, key := range CONFIG_KEYS {
+		_, name, _ := strings.Cut(key.Name, ".")
+		if name == "" {
+			name = key.Name
+		}
+		require.Contains(t, config, name+":")
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	require.Equal(t, "SIEVE_MONITOR_DKIM_KEY_FILE", EnvName("dkim.key_file"))
+	t.Setenv(EnvName("min_uid"), "2000")
+	secret := filepath.Join(t.TempDir(), "selector")
+	require.Nil(t, os.WriteFile(secret, []byte("s2025\n"), 0600))
+	t.Setenv(EnvName("dkim.selector"), "")
+	os.Unsetenv(EnvName("dkim.selector"))
+	t.Setenv(EnvName("dkim.selector")+"_FILE", secret)
+	defer viper.Set("dkim.selector", viper.GetString("dkim.selector"))
+	require.Nil(t, bindEnv())
+	require.Equal(t, 2000, viper.GetInt("min_uid"))
+	require.Equal(t, "s2025", viper.GetString("dkim.selector"))
+	require.Equal(t, "env", configSource("dkim.selector"))
+	_, found := os.LookupEnv(EnvName("dkim.selector"))
+	require.False(t, found)
+
+	t.Setenv(EnvName("dkim.selector"), "other")
+	require.NotNil(t, bindEnv())
+}
+
+func TestEffectiveConfigRedacted(t *testing.T) {
+	defer viper.Set("webhook_secret", "")
+	viper.Set("webhook_secret", "s3cret")
+	t.Setenv(EnvName("dkim.selector")+"_FILE", "/run/secrets/selector")
+	defer viper.Set("dkim.selector", viper.GetString("dkim.selector"))
+	viper.Set("dkim.selector", "s2025")
+	values := make(map[string]any)
+	for _, setting := range EffectiveConfig() {
+		values[setting.Key] = setting.Value
+	}
+	require.Equal(t, REDACTED, values["webhook_secret"])
+	require.Equal(t, REDACTED, values["dkim.selector"])
+	require.Equal(t, DEFAULT_LOG_LEVEL, values["log_level"])
+}
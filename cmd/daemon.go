@@ -1,84 +1,191 @@
 package cmd
 
 import (
-	"flag"
+	"context"
+	"fmt"
 	"github.com/rstms/go-daemon"
-	"log"
+	"github.com/spf13/viper"
+	"log/slog"
 	"os"
+	"os/signal"
 	"syscall"
 )
 
-type DaemonMain func()
+type DaemonMain func(ctx context.Context)
 
 var DaemonizeDisabled = false
 
+const DEFAULT_PIDFILE = "/var/run/sieve-monitor.pid"
+
 var (
-	signalFlag = flag.String("s", "", `send signal:
-    stop - shutdown
-    reload - reload config
-    `)
-	shutdown = make(chan struct{})
-	reload   = make(chan struct{})
+	signalFlag string
+	shutdown   = make(chan struct{})
+	stopped    = make(chan struct{})
+	reload     = make(chan struct{}, 1)
 )
 
 func stopHandler(sig os.Signal) error {
-	log.Println("daemonize: received stop signal, sending shutdown")
+	slog.Info("daemonize: received stop signal, sending shutdown")
 	shutdown <- struct{}{}
+	// wait for main to finish in-flight work before the process exits
+	<-stopped
 	return daemon.ErrStop
 }
 
 func reloadHandler(sig os.Signal) error {
-	log.Println("daemonize: received reload signal")
+	slog.Info("daemonize: received reload signal")
+	requestReload(reload)
 	return nil
 }
 
-func Daemonize(main DaemonMain, logFilename string, stopChan *chan struct{}) {
-
-	if DaemonizeDisabled {
-		main()
-		return
+// requestReload signals ch without blocking, so a reload arriving while
+// the monitor is stopping, or while a reload is pending, is dropped
+func requestReload(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+		slog.Warn("reload request dropped, monitor busy or stopping")
 	}
+}
 
-	daemon.AddCommand(daemon.StringFlag(signalFlag, "stop"), syscall.SIGTERM, stopHandler)
-	daemon.AddCommand(daemon.StringFlag(signalFlag, "reload"), syscall.SIGHUP, reloadHandler)
+func reopenHandler(sig os.Signal) error {
+	slog.Info("daemonize: received reopen signal")
+	ReopenLog()
+	return nil
+}
+
+func addCommands() {
+	daemon.AddCommand(daemon.StringFlag(&signalFlag, "stop"), syscall.SIGTERM, stopHandler)
+	daemon.AddCommand(daemon.StringFlag(&signalFlag, "reload"), syscall.SIGHUP, reloadHandler)
+	daemon.AddCommand(daemon.StringFlag(&signalFlag, "reopen"), syscall.SIGUSR1, reopenHandler)
+}
 
-	ctx := &daemon.Context{
+func daemonContext(logFilename string) *daemon.Context {
+	return &daemon.Context{
+		PidFileName: viper.GetString("pidfile"),
+		PidFilePerm: 0644,
 		LogFileName: logFilename,
 		LogFilePerm: 0600,
 		WorkDir:     "/",
 		Umask:       007,
 	}
+}
+
+// SendSignal delivers the signal named by the --signal flag to the running daemon
+func SendSignal() {
+	addCommands()
+	if len(daemon.ActiveFlags()) == 0 {
+		Fatal("daemonize: unknown signal command", "error", fmt.Errorf("unknown signal: %s", signalFlag))
+	}
+	d, err := daemonContext("").Search()
+	if err != nil {
+		Fatal("daemonize: failed sending signal", "error", err)
+	}
+	err = daemon.SendCommands(d)
+	if err != nil {
+		Fatal("daemonize: failed sending signal", "error", err)
+	}
+}
+
+// runForeground runs main without forking; SIGHUP and SIGUSR1 reload and
+// reopen the log as they do for the daemon, other signals stop main
+func runForeground(main DaemonMain, reloadChan *chan struct{}) {
+	var reload chan struct{}
+	if reloadChan != nil {
+		reload = *reloadChan
+	}
+	runWithSignals("foreground", main, reload, nil)
+}
 
-	if len(daemon.ActiveFlags()) > 0 {
-		d, err := ctx.Search()
-		if err != nil {
-			log.Fatalf("daemonize: failed sending signal: %v", err)
+// runWithSignals runs main until it returns, turning SIGHUP into a reload
+// request, SIGUSR1 into a log reopen and any other signal into a stop,
+// calling stopping first when set; prefix names the mode in log messages
+func runWithSignals(prefix string, main DaemonMain, reload chan struct{}, stopping func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		main(ctx)
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				slog.Info(prefix + ": received reload signal")
+				if reload != nil {
+					requestReload(reload)
+				}
+			case syscall.SIGUSR1:
+				slog.Info(prefix + ": received reopen signal")
+				ReopenLog()
+			default:
+				slog.Info(prefix+": received stop signal", "signal", sig.String())
+				if stopping != nil {
+					stopping()
+				}
+				cancel()
+			}
 		}
-		daemon.SendCommands(d)
+	}
+}
+
+func Daemonize(main DaemonMain, logFilename string, reloadChan *chan struct{}) {
+
+	if DaemonizeDisabled {
+		runForeground(main, reloadChan)
 		return
 	}
 
-	child, err := ctx.Reborn()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addCommands()
+	dctx := daemonContext(logFilename)
+
+	child, err := dctx.Reborn()
 	if err != nil {
-		log.Fatalf("daemonize: Fork failed: %v", err)
+		Fatal("daemonize: Fork failed", "error", err)
 	}
 
 	if child != nil {
 		return
 	}
-	defer ctx.Release()
+	defer dctx.Release()
+
+	done := make(chan struct{})
+	go func() {
+		main(ctx)
+		close(done)
+	}()
 
 	go func() {
-		go main()
-		<-shutdown
-		if stopChan != nil {
-			*stopChan <- struct{}{}
+		for {
+			select {
+			case <-reload:
+				if reloadChan != nil {
+					requestReload(*reloadChan)
+				}
+			case <-shutdown:
+				cancel()
+				<-done
+				slog.Info("daemonize: received shutdown, exiting")
+				stopped <- struct{}{}
+				return
+			}
 		}
-		log.Println("daemonize: received shutdown, exiting")
 	}()
 
 	err = daemon.ServeSignals()
 	if err != nil {
-		log.Fatalf("daemonize: ServeSignals failed: %v", err)
+		Fatal("daemonize: ServeSignals failed", "error", err)
 	}
 }
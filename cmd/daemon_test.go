@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunForegroundSignals(t *testing.T) {
+	reload := make(chan struct{}, 1)
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		runForeground(func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+		}, &reload)
+		close(finished)
+	}()
+	<-started
+
+	require.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+	select {
+	case <-reload:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not forwarded")
+	}
+	require.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop signal ignored")
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/spf13/viper"
+)
+
+var DKIM_HEADER_KEYS = []string{
+	"From", "To", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "Auto-Submitted", "List-Id",
+	"Content-Type", "MIME-Version",
+}
+
+// Signer is set when DKIM signing is configured
+var Signer *DKIMSigner
+
+// DKIMSigner holds signing options for each configured domain.  Messages
+// are signed for the host's mail domain, so a dkim.domains entry applies
+// when its name matches the domain setting; one config file can then carry
+// the keys for every host of a multi-domain site, and the default key
+// signs for any other domain.
+type DKIMSigner struct {
+	Default *dkim.SignOptions
+	Domains map[string]*dkim.SignOptions
+}
+
+type DKIMKeyConfig struct {
+	Selector string `mapstructure:"selector"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// LoadDKIMSigner reads the dkim config section, returning nil if no key
+// is configured
+func LoadDKIMSigner() (*DKIMSigner, error) {
+	signer := DKIMSigner{Domains: make(map[string]*dkim.SignOptions)}
+	if viper.GetString("dkim.key_file") != "" {
+		domain := viper.GetString("dkim.domain")
+		if domain == "" {
+			domain = viper.GetString("domain")
+		}
+		options, err := newSignOptions(domain, viper.GetString("dkim.selector"), viper.GetString("dkim.key_file"))
+		if err != nil {
+			return nil, err
+		}
+		signer.Default = options
+	}
+	domains := make(map[string]DKIMKeyConfig)
+	err := viper.UnmarshalKey("dkim.domains", &domains)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing dkim.domains: %v", err)
+	}
+	for domain, config := range domains {
+		options, err := newSignOptions(domain, config.Selector, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer.Domains[strings.ToLower(domain)] = options
+	}
+	if signer.Default == nil && len(signer.Domains) == 0 {
+		return nil, nil
+	}
+	return &signer, nil
+}
+
+func newSignOptions(domain, selector, keyFile string) (*dkim.SignOptions, error) {
+	if domain == "" || selector == "" {
+		return nil, fmt.Errorf("dkim key %s requires a domain and selector", keyFile)
+	}
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	options := dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             DKIM_HEADER_KEYS,
+	}
+	return &options, nil
+}
+
+func readPrivateKey(filename string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found in %s", filename)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key in %s", filename)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %s in %s", block.Type, filename)
+}
+
+// Sign returns message with a DKIM-Signature for domain prepended; with
+// no key for domain the message is returned unchanged
+func (s *DKIMSigner) Sign(domain string, message *bytes.Buffer) (*bytes.Buffer, error) {
+	options, ok := s.Domains[strings.ToLower(domain)]
+	if !ok {
+		options = s.Default
+	}
+	if options == nil {
+		return message, nil
+	}
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, bytes.NewReader(message.Bytes()), options)
+	if err != nil {
+		return nil, fmt.Errorf("dkim signing failed: %v", err)
+	}
+	return &signed, nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKey(t *testing.T, filename string, key any) {
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data})
+	require.Nil(t, os.WriteFile(filename, block, 0600))
+}
+
+func TestDKIMSign(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	writeKey(t, filepath.Join(dir, "default.pem"), rsaKey)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	writeKey(t, filepath.Join(dir, "other.pem"), edKey)
+
+	viper.Set("dkim.selector", "mail")
+	viper.Set("dkim.domain", "example.org")
+	viper.Set("dkim.key_file", filepath.Join(dir, "default.pem"))
+	viper.Set("dkim.domains", map[string]any{
+		"example.net": map[string]any{"selector": "ed", "key_file": filepath.Join(dir, "other.pem")},
+	})
+	defer func() {
+		viper.Set("dkim.key_file", "")
+		viper.Set("dkim.domains", map[string]any{})
+	}()
+
+	signer, err := LoadDKIMSigner()
+	require.Nil(t, err)
+	require.NotNil(t, signer)
+
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+	records := map[string]string{
+		"mail._domainkey.example.org": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic),
+		"ed._domainkey.example.net":   "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic),
+	}
+	options := dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			record, ok := records[domain]
+			if !ok {
+				return nil, fmt.Errorf("no record for %s", domain)
+			}
+			return []string{record}, nil
+		},
+	}
+
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	for _, domain := range []string{"example.org", "example.net"} {
+		var buf bytes.Buffer
+		_, err = formatMessage("alice", domain, "", trace, NewMonitorID(), &buf)
+		require.Nil(t, err)
+		signed, err := signer.Sign(domain, &buf)
+		require.Nil(t, err)
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed.Bytes()), &options)
+		require.Nil(t, err)
+		require.Len(t, verifications, 1)
+		require.Nil(t, verifications[0].Err)
+		require.Equal(t, domain, verifications[0].Domain)
+		// the body's MIME structure is covered by the signature
+		require.Contains(t, verifications[0].HeaderKeys, "Content-Type")
+		require.Contains(t, verifications[0].HeaderKeys, "MIME-Version")
+	}
+}
@@ -32,12 +32,17 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-message/mail"
@@ -63,7 +68,41 @@ func addPart(mailWriter *mail.Writer, buf *bytes.Buffer) error {
 	return nil
 }
 
-func formatMessage(username, domain, filename string, buf *bytes.Buffer) error {
+// newMessageID returns a unique Message-ID in our domain
+func newMessageID(domain string) string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(buf), domain)
+}
+
+// traceMessageID returns a Message-ID derived from the traced message, so
+// a re-sent trace replaces rather than duplicates the earlier one; traces
+// with nothing to identify them get a random id
+func traceMessageID(username, domain string, trace *Trace) string {
+	identity := trace.MessageID
+	if identity == "" {
+		identity = trace.SessionID
+	}
+	if identity == "" {
+		return newMessageID(domain)
+	}
+	hash := sha256.Sum256([]byte(username + "\x00" + trace.Kind + "\x00" + identity))
+	return fmt.Sprintf("sieve-trace.%s@%s", hex.EncodeToString(hash[:12]), domain)
+}
+
+// traceSubject returns the subject for a trace message
+func traceSubject(trace *Trace) string {
+	if trace.Subject != "" {
+		return fmt.Sprintf("Sieve Trace: %s", trace.Subject)
+	}
+	_, basename := filepath.Split(trace.Filename)
+	return fmt.Sprintf("Sieve Trace: %s", basename)
+}
+
+// newHeader returns the common header for mail sent to username, marked
+// per RFC 3834 so vacation responders and list filters leave it alone;
+// the caller sets the Message-ID
+func newHeader(username, domain, subject, monitorID string) mail.Header {
 
 	from := []*mail.Address{{Name: "Sieve Daemon", Address: fmt.Sprintf("SIEVE-DAEMON@%s", domain)}}
 	to := []*mail.Address{{Address: username + "@" + domain}}
@@ -72,12 +111,47 @@ func formatMessage(username, domain, filename string, buf *bytes.Buffer) error {
 	mailHeader.SetDate(time.Now())
 	mailHeader.SetAddressList("From", from)
 	mailHeader.SetAddressList("To", to)
-	_, basename := filepath.Split(filename)
-	mailHeader.SetSubject(fmt.Sprintf("Sieve Trace: %s", basename))
+	mailHeader.SetSubject(subject)
+	mailHeader.Set("Auto-Submitted", "auto-generated")
+	mailHeader.Set("Precedence", "bulk")
+	mailHeader.Set("List-Id", fmt.Sprintf("Sieve Trace <sieve-trace.%s>", domain))
+	// mark our mail so traces of its delivery are recognised as loops
+	mailHeader.Set("X-Sieve-Monitor-Id", monitorID)
+	mailHeader.Set("X-Sieve-Trace-Username", username)
+	return mailHeader
+}
+
+// formatMessage builds the trace message for username; a non-empty to
+// replaces the user's address as the recipient
+func formatMessage(username, domain, to string, trace *Trace, monitorID string, buf *bytes.Buffer) (string, error) {
+
+	filename := trace.Filename
+	mailHeader := newHeader(username, domain, traceSubject(trace), monitorID)
+	if to != "" {
+		addresses, err := mail.ParseAddressList(to)
+		if err != nil {
+			return "", err
+		}
+		mailHeader.SetAddressList("To", addresses)
+	}
+	messageID := traceMessageID(username, domain, trace)
+	mailHeader.SetMessageID(messageID)
+	if trace.MessageID != "" {
+		// thread the trace with the message it describes
+		mailHeader.SetMsgIDList("In-Reply-To", []string{trace.MessageID})
+		mailHeader.SetMsgIDList("References", []string{trace.MessageID})
+	}
+	mailHeader.Set("X-Sieve-Trace-Kind", trace.Kind)
+	if trace.SessionID != "" {
+		mailHeader.Set("X-Sieve-Trace-Session-Id", trace.SessionID)
+	}
+	if trace.Sender != "" {
+		mailHeader.Set("X-Sieve-Trace-Sender", trace.Sender)
+	}
 
 	mailWriter, err := mail.CreateWriter(buf, mailHeader)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer mailWriter.Close()
 
@@ -92,24 +166,105 @@ func formatMessage(username, domain, filename string, buf *bytes.Buffer) error {
 
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = addPart(mailWriter, bytes.NewBuffer(data))
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return messageID, nil
 }
 
-func SendFile(username, domain, filename string) error {
+// digestSummary returns the text telling a user their traces were rate
+// limited, listing the suppressed files
+func digestSummary(username, domain string, filenames []string) string {
+	var notice strings.Builder
+	fmt.Fprintf(&notice, "Sieve trace delivery to %s@%s was rate limited.\n", username, domain)
+	fmt.Fprintf(&notice, "%d traces were suppressed:\n\n", len(filenames))
+	for _, filename := range digestTraces(filenames) {
+		_, basename := filepath.Split(filename)
+		fmt.Fprintf(&notice, "  %s\n", basename)
+	}
+	if len(filenames) > DIGEST_MAX_TRACES {
+		fmt.Fprintf(&notice, "  and %d more\n", len(filenames)-DIGEST_MAX_TRACES)
+	}
+	return notice.String()
+}
 
-	var buf bytes.Buffer
-	err := formatMessage(username, domain, filename, &buf)
+// digestTraces returns the held traces a digest carries
+func digestTraces(filenames []string) []string {
+	return filenames[:min(len(filenames), DIGEST_MAX_TRACES)]
+}
+
+// formatDigest builds a single message carrying the first DIGEST_MAX_TRACES
+// held traces, headed by a notice saying how many the rate limit suppressed
+func formatDigest(username, domain string, filenames []string, buf *bytes.Buffer) (string, error) {
+
+	subject := fmt.Sprintf("Sieve Trace: rate limited, %d traces suppressed", len(filenames))
+	mailHeader := newHeader(username, domain, subject, NewMonitorID())
+	messageID := newMessageID(domain)
+	mailHeader.SetMessageID(messageID)
+	mailHeader.Set("X-Sieve-Trace-Kind", "digest")
+
+	mailWriter, err := mail.CreateWriter(buf, mailHeader)
+	if err != nil {
+		return "", err
+	}
+	defer mailWriter.Close()
+
+	err = addPart(mailWriter, bytes.NewBufferString(digestSummary(username, domain, filenames)))
+	if err != nil {
+		return "", err
+	}
+
+	for _, filename := range digestTraces(filenames) {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		err = addPart(mailWriter, bytes.NewBuffer(data))
+		if err != nil {
+			return "", err
+		}
+	}
+	return messageID, nil
+}
+
+// signMessage returns buf DKIM signed when a signer is configured
+func signMessage(domain string, buf *bytes.Buffer) (*bytes.Buffer, error) {
+	if Signer == nil {
+		return buf, nil
+	}
+	return Signer.Sign(domain, buf)
+}
+
+// formatNotice builds a plain text message from the daemon to username
+func formatNotice(username, domain, subject, text string, buf *bytes.Buffer) (string, error) {
+
+	mailHeader := newHeader(username, domain, subject, NewMonitorID())
+	messageID := newMessageID(domain)
+	mailHeader.SetMessageID(messageID)
+	mailHeader.Set("X-Sieve-Trace-Kind", "notice")
+
+	mailWriter, err := mail.CreateWriter(buf, mailHeader)
+	if err != nil {
+		return "", err
+	}
+	defer mailWriter.Close()
+
+	err = addPart(mailWriter, bytes.NewBufferString(text))
+	if err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+func sendmail(ctx context.Context, domain string, buf *bytes.Buffer) error {
+	buf, err := signMessage(domain, buf)
 	if err != nil {
 		return err
 	}
-	log.Printf("Sending %s to %s@%s\n", filename, username, domain)
-	cmd := exec.Command("sendmail", "-t")
+	cmd := exec.CommandContext(ctx, "sendmail", "-t")
 	cmd.Stdin = bytes.NewReader(buf.Bytes())
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -117,3 +272,104 @@ func SendFile(username, domain, filename string) error {
 	}
 	return nil
 }
+
+func SendDigest(ctx context.Context, username, domain string, filenames []string) error {
+
+	var buf bytes.Buffer
+	messageID, err := formatDigest(username, domain, filenames, &buf)
+	if err != nil {
+		return err
+	}
+	message, encryption, err := EncryptForUser(username, &buf)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sendmail(ctx, domain, message)
+	if err != nil {
+		return err
+	}
+	slog.Info("sent digest",
+		LOG_USER, username,
+		"to", username+"@"+domain,
+		"count", len(filenames),
+		"encryption", encryption,
+		LOG_MESSAGE_ID, messageID,
+		LOG_DURATION, time.Since(start),
+	)
+	return nil
+}
+
+// NewTraceMessage returns the trace message for username, encrypted when
+// the user has a key, along with its Message-ID and encryption method
+func NewTraceMessage(username, domain, to string, trace *Trace, monitorID string) (*bytes.Buffer, string, string, error) {
+	var buf bytes.Buffer
+	messageID, err := formatMessage(username, domain, to, trace, monitorID, &buf)
+	if err != nil {
+		return nil, "", "", err
+	}
+	message, encryption, err := EncryptForUser(username, &buf)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return message, messageID, encryption, nil
+}
+
+func SendNotice(ctx context.Context, username, domain, subject, text string) error {
+
+	var buf bytes.Buffer
+	messageID, err := formatNotice(username, domain, subject, text, &buf)
+	if err != nil {
+		return err
+	}
+	message, encryption, err := EncryptForUser(username, &buf)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sendmail(ctx, domain, message)
+	if err != nil {
+		return err
+	}
+	slog.Info("sent notice",
+		LOG_USER, username,
+		"to", username+"@"+domain,
+		"subject", subject,
+		"encryption", encryption,
+		LOG_MESSAGE_ID, messageID,
+		LOG_DURATION, time.Since(start),
+	)
+	return nil
+}
+
+func SendFile(ctx context.Context, username, domain string, trace *Trace, monitorID string) (string, error) {
+	return SendFileTo(ctx, username, domain, "", trace, monitorID)
+}
+
+// SendFileTo sends the trace message for username to the address to, or to
+// the user when to is empty, returning the Message-ID of the message sent
+func SendFileTo(ctx context.Context, username, domain, to string, trace *Trace, monitorID string) (string, error) {
+
+	filename := trace.Filename
+	message, messageID, encryption, err := NewTraceMessage(username, domain, to, trace, monitorID)
+	if err != nil {
+		return "", err
+	}
+	if to == "" {
+		to = username + "@" + domain
+	}
+	start := time.Now()
+	err = sendmail(ctx, domain, message)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("sent",
+		LOG_USER, username,
+		"to", to,
+		LOG_FILE, filename,
+		"encryption", encryption,
+		LOG_MESSAGE_ID, messageID,
+		LOG_DURATION, time.Since(start),
+	)
+	return messageID, nil
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/emersion/go-message/mail"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestFormatMessageHeaders(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	messageID, err := formatMessage("alice", "example.org", "", trace, NewMonitorID(), &buf)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(messageID, "@example.org"))
+
+	reader, err := mail.CreateReader(&buf)
+	require.Nil(t, err)
+	header := reader.Header
+	require.Equal(t, "auto-generated", header.Get("Auto-Submitted"))
+	require.Equal(t, "bulk", header.Get("Precedence"))
+	require.Equal(t, "Sieve Trace <sieve-trace.example.org>", header.Get("List-Id"))
+	require.Equal(t, "alice", header.Get("X-Sieve-Trace-Username"))
+	require.Equal(t, "cP4pErgcP2hwVQEA8o/S4w", header.Get("X-Sieve-Trace-Session-Id"))
+	require.Equal(t, TRACE_KIND_DELIVERY, header.Get("X-Sieve-Trace-Kind"))
+	require.Equal(t, "email_feedback_handler@bbcsreturn.convio.net", header.Get("X-Sieve-Trace-Sender"))
+	require.True(t, strings.HasPrefix(header.Get("X-Sieve-Monitor-Id"), MONITOR_ID_PREFIX))
+	headerID, err := header.MessageID()
+	require.Nil(t, err)
+	require.Equal(t, messageID, headerID)
+}
+
+func TestFormatMessageThread(t *testing.T) {
+	trace, err := ParseTrace("testdata/thread.trace")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	messageID, err := formatMessage("alice", "example.org", "", trace, NewMonitorID(), &buf)
+	require.Nil(t, err)
+	// the id is stable across sends of the same trace
+	require.Equal(t, traceMessageID("alice", "example.org", trace), messageID)
+
+	reader, err := mail.CreateReader(&buf)
+	require.Nil(t, err)
+	header := reader.Header
+	subject, err := header.Subject()
+	require.Nil(t, err)
+	require.Equal(t, "Sieve Trace: Quarterly report draft", subject)
+	inReplyTo, err := header.MsgIDList("In-Reply-To")
+	require.Nil(t, err)
+	require.Equal(t, []string{"CAF3x9k2@mail.example.com"}, inReplyTo)
+	references, err := header.MsgIDList("References")
+	require.Nil(t, err)
+	require.Equal(t, []string{"CAF3x9k2@mail.example.com"}, references)
+}
+
+func TestFormatMessageTo(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	_, err = formatMessage("alice", "example.org", "postmaster@example.net", trace, NewMonitorID(), &buf)
+	require.Nil(t, err)
+	reader, err := mail.CreateReader(&buf)
+	require.Nil(t, err)
+	to, err := reader.Header.AddressList("To")
+	require.Nil(t, err)
+	require.Len(t, to, 1)
+	require.Equal(t, "postmaster@example.net", to[0].Address)
+	require.Equal(t, "alice", reader.Header.Get("X-Sieve-Trace-Username"))
+}
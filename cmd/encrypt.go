@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	nettextproto "net/textproto"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/textproto"
+	"github.com/smallstep/pkcs7"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_ENCRYPTION = "auto"
+const DEFAULT_ENCRYPTION_PGP_KEY = ".sieve-monitor/pubkey.asc"
+const DEFAULT_ENCRYPTION_SMIME_CERT = ".sieve-monitor/smime.crt"
+const DEFAULT_ENCRYPTION_FAILURE = "skip"
+
+// MAX_KEY_FILE_SIZE bounds how much of a user's key or certificate is read
+const MAX_KEY_FILE_SIZE = 256 * 1024
+
+const ENCRYPTED_SUBJECT = "Sieve Trace (encrypted)"
+
+// headers revealing details of the traced message travel only inside the
+// encrypted part
+var PROTECTED_HEADERS = []string{
+	"Subject",
+	"In-Reply-To",
+	"References",
+	"X-Sieve-Trace-Sender",
+	"X-Sieve-Trace-Session-Id",
+}
+
+func init() {
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// EncryptionError reports a user's key or certificate that could not be
+// used; the file is under the user's control, so it must never stop the
+// daemon
+type EncryptionError struct {
+	Method string
+	Err    error
+}
+
+func (e *EncryptionError) Error() string {
+	return fmt.Sprintf("%s encryption failed: %v", e.Method, e.Err)
+}
+
+func (e *EncryptionError) Unwrap() error {
+	return e.Err
+}
+
+// EncryptForUser encrypts message to the OpenPGP key or S/MIME certificate
+// found in the user's home directory, returning the method used or "" if
+// the message was left unencrypted.  When the key is unusable the message
+// is sent unencrypted if encryption_failure is "plain", otherwise an
+// EncryptionError is returned.
+func EncryptForUser(username string, message *bytes.Buffer) (*bytes.Buffer, string, error) {
+	if viper.GetString("encryption") == "off" {
+		return message, "", nil
+	}
+	home, uid := userAccount(username)
+	pgpKey := filepath.Join(home, viper.GetString("encryption_pgp_key"))
+	smimeCert := filepath.Join(home, viper.GetString("encryption_smime_cert"))
+	return encryptWithPolicy(username, message, pgpKey, smimeCert, uid)
+}
+
+// encryptWithPolicy applies the encryption_failure policy to encryptMessage
+func encryptWithPolicy(username string, message *bytes.Buffer, pgpKey, smimeCert string, owner int) (*bytes.Buffer, string, error) {
+	encrypted, method, err := encryptMessage(message, pgpKey, smimeCert, owner)
+	if err != nil && viper.GetString("encryption_failure") == "plain" {
+		slog.Warn("encryption failed, sending unencrypted", LOG_USER, username, "error", err)
+		return message, "", nil
+	}
+	return encrypted, method, err
+}
+
+// userAccount returns the home directory and uid of username, falling back
+// to the /home convention used for users named in the config; without an
+// account no key file is trusted, so the uid is -1
+func userAccount(username string) (string, int) {
+	account, err := user.Lookup(username)
+	if err != nil {
+		return filepath.Join(HOME_DIR, username), -1
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return account.HomeDir, -1
+	}
+	return account.HomeDir, uid
+}
+
+// readKeyFile reads a key or certificate from a user's home directory,
+// returning nil if there is none.  The daemon runs as root and the path is
+// under the user's control, so symlinks are not followed, the file must be
+// a regular file owned by owner, and its size is bounded.
+func readKeyFile(filename string, owner int) ([]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	fd, err := unix.Open(filename, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", filename, err)
+	}
+	file := os.NewFile(uintptr(fd), filename)
+	defer file.Close()
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return nil, fmt.Errorf("failed checking %s: %v", filename, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil, fmt.Errorf("refusing to read %s: not a regular file", filename)
+	}
+	if int64(stat.Uid) != int64(owner) {
+		return nil, fmt.Errorf("refusing to read %s: owned by uid %d", filename, stat.Uid)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, MAX_KEY_FILE_SIZE+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", filename, err)
+	}
+	if len(data) > MAX_KEY_FILE_SIZE {
+		return nil, fmt.Errorf("refusing to read %s: larger than %d bytes", filename, MAX_KEY_FILE_SIZE)
+	}
+	return data, nil
+}
+
+// encryptMessage encrypts to the OpenPGP key if present, or else to the
+// S/MIME certificate; key files must belong to owner
+func encryptMessage(message *bytes.Buffer, pgpKey, smimeCert string, owner int) (*bytes.Buffer, string, error) {
+	key, err := readKeyFile(pgpKey, owner)
+	if err != nil {
+		return nil, "", &EncryptionError{Method: "pgp", Err: err}
+	}
+	if key != nil {
+		encrypted, err := encryptPGP(message, pgpKey, key)
+		if err != nil {
+			return nil, "", &EncryptionError{Method: "pgp", Err: err}
+		}
+		return encrypted, "pgp", nil
+	}
+	cert, err := readKeyFile(smimeCert, owner)
+	if err != nil {
+		return nil, "", &EncryptionError{Method: "smime", Err: err}
+	}
+	if cert != nil {
+		encrypted, err := encryptSMIME(message, smimeCert, cert)
+		if err != nil {
+			return nil, "", &EncryptionError{Method: "smime", Err: err}
+		}
+		return encrypted, "smime", nil
+	}
+	return message, "", nil
+}
+
+// splitMessage separates a message into the outer header and the inner
+// entity (content headers, protected headers and body) to be encrypted
+func splitMessage(message *bytes.Buffer) (textproto.Header, []byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(message.Bytes()))
+	header, err := textproto.ReadHeader(reader)
+	if err != nil {
+		return header, nil, err
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return header, nil, err
+	}
+
+	var outer, inner textproto.Header
+	fields := header.Fields()
+	for fields.Next() {
+		key := nettextproto.CanonicalMIMEHeaderKey(fields.Key())
+		switch {
+		case strings.HasPrefix(key, "Content-"):
+			inner.Add(key, fields.Value())
+		case isProtectedHeader(key):
+			inner.Add(key, fields.Value())
+		case key == "Mime-Version":
+		default:
+			outer.Add(key, fields.Value())
+		}
+	}
+	if header.Has("Subject") {
+		outer.Set("Subject", ENCRYPTED_SUBJECT)
+	}
+	outer.Set("MIME-Version", "1.0")
+
+	var entity bytes.Buffer
+	err = textproto.WriteHeader(&entity, inner)
+	if err != nil {
+		return outer, nil, err
+	}
+	entity.Write(body)
+	return outer, entity.Bytes(), nil
+}
+
+func isProtectedHeader(key string) bool {
+	for _, protected := range PROTECTED_HEADERS {
+		if strings.EqualFold(key, protected) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptPGP produces an RFC 3156 PGP/MIME encrypted message
+func encryptPGP(message *bytes.Buffer, keyFile string, key []byte) (*bytes.Buffer, error) {
+	recipients, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", keyFile, err)
+	}
+
+	outer, entity, err := splitMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var armored bytes.Buffer
+	armorWriter, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(armorWriter, recipients, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = plaintext.Write(entity)
+	if err != nil {
+		return nil, err
+	}
+	err = plaintext.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = armorWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	part, err := parts.CreatePart(nettextproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(part, "Version: 1\r\n")
+	part, err = parts.CreatePart(nettextproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(armored.Bytes())
+	err = parts.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	outer.Set("Content-Type", fmt.Sprintf(`multipart/encrypted; protocol="application/pgp-encrypted"; boundary="%s"`, parts.Boundary()))
+	var encrypted bytes.Buffer
+	err = textproto.WriteHeader(&encrypted, outer)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Write(body.Bytes())
+	return &encrypted, nil
+}
+
+// encryptSMIME produces an RFC 8551 enveloped-data message
+func encryptSMIME(message *bytes.Buffer, certFile string, data []byte) (*bytes.Buffer, error) {
+	recipients := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", certFile, err)
+		}
+		recipients = append(recipients, cert)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	outer, entity, err := splitMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := pkcs7.Encrypt(entity, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	outer.Set("Content-Type", `application/pkcs7-mime; smime-type=enveloped-data; name="smime.p7m"`)
+	outer.Set("Content-Transfer-Encoding", "base64")
+	outer.Set("Content-Disposition", `attachment; filename="smime.p7m"`)
+	var encrypted bytes.Buffer
+	err = textproto.WriteHeader(&encrypted, outer)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(envelope)
+	for len(encoded) > 76 {
+		encrypted.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	encrypted.WriteString(encoded + "\r\n")
+	return &encrypted, nil
+}
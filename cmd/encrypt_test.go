@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/mail"
+	"github.com/smallstep/pkcs7"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func formatTestMessage(t *testing.T) *bytes.Buffer {
+	trace, err := ParseTrace("testdata/thread.trace")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	_, err = formatMessage("alice", "example.org", "", trace, NewMonitorID(), &buf)
+	require.Nil(t, err)
+	return &buf
+}
+
+func TestEncryptPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("alice", "", "alice@example.org", nil)
+	require.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "pubkey.asc")
+	file, err := os.Create(keyFile)
+	require.Nil(t, err)
+	writer, err := armor.Encode(file, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(writer))
+	require.Nil(t, writer.Close())
+	require.Nil(t, file.Close())
+
+	encrypted, method, err := encryptMessage(formatTestMessage(t), keyFile, "", os.Getuid())
+	require.Nil(t, err)
+	require.Equal(t, "pgp", method)
+	text := encrypted.String()
+	require.NotContains(t, text, "Quarterly report draft")
+	require.NotContains(t, text, "Session ID:")
+
+	reader, err := mail.CreateReader(encrypted)
+	require.Nil(t, err)
+	subject, err := reader.Header.Subject()
+	require.Nil(t, err)
+	require.Equal(t, ENCRYPTED_SUBJECT, subject)
+	require.Contains(t, reader.Header.Get("Content-Type"), "multipart/encrypted")
+
+	start := strings.Index(text, "-----BEGIN PGP MESSAGE-----")
+	require.True(t, start > 0)
+	block, err := armor.Decode(strings.NewReader(text[start:]))
+	require.Nil(t, err)
+	message, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	require.Nil(t, err)
+	plaintext, err := io.ReadAll(message.UnverifiedBody)
+	require.Nil(t, err)
+	require.Contains(t, string(plaintext), "Subject: Sieve Trace: Quarterly report draft")
+	require.Contains(t, string(plaintext), "Session ID: RmV9x1pEP2hwVQEA8o/S4w")
+}
+
+func TestEncryptSMIME(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice@example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	certFile := filepath.Join(t.TempDir(), "smime.crt")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	encrypted, method, err := encryptMessage(formatTestMessage(t), "", certFile, os.Getuid())
+	require.Nil(t, err)
+	require.Equal(t, "smime", method)
+	require.NotContains(t, encrypted.String(), "Quarterly report draft")
+
+	reader := bufio.NewReader(encrypted)
+	header, err := mail.CreateReader(bytes.NewReader(encrypted.Bytes()))
+	require.Nil(t, err)
+	require.Contains(t, header.Header.Get("Content-Type"), "application/pkcs7-mime")
+	// skip the header to the base64 body
+	for {
+		line, err := reader.ReadString('\n')
+		require.Nil(t, err)
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+	body, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	der, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\r\n", ""))
+	require.Nil(t, err)
+	p7, err := pkcs7.Parse(der)
+	require.Nil(t, err)
+	plaintext, err := p7.Decrypt(cert, key)
+	require.Nil(t, err)
+	require.Contains(t, string(plaintext), "Subject: Sieve Trace: Quarterly report draft")
+	require.Contains(t, string(plaintext), "Session ID: RmV9x1pEP2hwVQEA8o/S4w")
+}
+
+func TestEncryptNoKey(t *testing.T) {
+	message := formatTestMessage(t)
+	encrypted, method, err := encryptMessage(message, "/nonexistent/pubkey.asc", "/nonexistent/smime.crt", os.Getuid())
+	require.Nil(t, err)
+	require.Equal(t, "", method)
+	require.Equal(t, message, encrypted)
+}
+
+func TestEncryptBadKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "pubkey.asc")
+	err := os.WriteFile(keyFile, []byte("not a key\n"), 0600)
+	require.Nil(t, err)
+	message := formatTestMessage(t)
+
+	_, _, err = encryptMessage(message, keyFile, "/nonexistent/smime.crt", os.Getuid())
+	var encryptionError *EncryptionError
+	require.ErrorAs(t, err, &encryptionError)
+	require.Equal(t, "pgp", encryptionError.Method)
+
+	defer viper.Set("encryption_failure", DEFAULT_ENCRYPTION_FAILURE)
+	viper.Set("encryption_failure", "skip")
+	_, _, err = encryptWithPolicy("alice", message, keyFile, "/nonexistent/smime.crt", os.Getuid())
+	require.ErrorAs(t, err, &encryptionError)
+
+	viper.Set("encryption_failure", "plain")
+	encrypted, method, err := encryptWithPolicy("alice", message, keyFile, "/nonexistent/smime.crt", os.Getuid())
+	require.Nil(t, err)
+	require.Equal(t, "", method)
+	require.Equal(t, message, encrypted)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "pubkey.asc")
+	require.Nil(t, os.WriteFile(keyFile, []byte("key\n"), 0600))
+	data, err := readKeyFile(keyFile, os.Getuid())
+	require.Nil(t, err)
+	require.Equal(t, "key\n", string(data))
+
+	data, err = readKeyFile(filepath.Join(dir, "missing.asc"), os.Getuid())
+	require.Nil(t, err)
+	require.Nil(t, data)
+
+	_, err = readKeyFile(keyFile, os.Getuid()+1)
+	require.NotNil(t, err)
+
+	link := filepath.Join(dir, "link.asc")
+	require.Nil(t, os.Symlink(keyFile, link))
+	_, err = readKeyFile(link, os.Getuid())
+	require.NotNil(t, err)
+
+	fifo := filepath.Join(dir, "fifo.asc")
+	require.Nil(t, syscall.Mkfifo(fifo, 0600))
+	_, err = readKeyFile(fifo, os.Getuid())
+	require.NotNil(t, err)
+
+	large := filepath.Join(dir, "large.asc")
+	require.Nil(t, os.WriteFile(large, make([]byte, MAX_KEY_FILE_SIZE+1), 0600))
+	_, err = readKeyFile(large, os.Getuid())
+	require.NotNil(t, err)
+}
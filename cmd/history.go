@@ -0,0 +1,521 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+const DEFAULT_HISTORY_FILE = "/var/lib/sieve-monitor/history.db"
+const DEFAULT_HISTORY_RETENTION_DAYS = 90
+const DEFAULT_HISTORY_LIMIT = 50
+
+// HISTORY_PRUNE_INTERVAL is how often records past history_retention_days
+// are removed
+const HISTORY_PRUNE_INTERVAL = 24 * time.Hour
+
+// trace outcomes recorded in the history
+const HISTORY_FORWARDED = "forwarded"
+const HISTORY_SKIPPED = "skipped"
+const HISTORY_HELD = "held"
+const HISTORY_REJECTED = "rejected"
+const HISTORY_DUPLICATE = "duplicate"
+
+var HISTORY_RECORDS = []byte("records")
+
+// HISTORY_INDEXES are the searchable fields; each index key is the lower
+// case value, a zero byte and the record id, so one value's entries sort
+// by time
+var HISTORY_INDEXES = map[string]func(*HistoryRecord) []string{
+	"user":      func(r *HistoryRecord) []string { return []string{r.Username} },
+	"sender":    func(r *HistoryRecord) []string { return []string{r.Sender} },
+	"recipient": func(r *HistoryRecord) []string { return []string{r.Recipient} },
+	"script":    func(r *HistoryRecord) []string { return r.Scripts },
+	"action":    func(r *HistoryRecord) []string { return r.Actions },
+}
+
+// HistoryRecord is a processed trace with its outcome and raw text
+type HistoryRecord struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Username  string    `json:"username"`
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Scripts   []string  `json:"scripts,omitempty"`
+	Actions   []string  `json:"actions,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	Trace     *Trace    `json:"trace"`
+	Raw       string    `json:"raw"`
+}
+
+// NewHistoryRecord returns the history record for a parsed trace
+func NewHistoryRecord(username string, trace *Trace, raw []byte, outcome, reason string) *HistoryRecord {
+	record := HistoryRecord{
+		Time:      time.Now(),
+		Username:  username,
+		Sender:    trace.Sender,
+		Recipient: strings.Trim(trace.Fields["Final recipient"], "<>"),
+		MessageID: trace.MessageID,
+		Subject:   trace.Subject,
+		Actions:   trace.Actions,
+		Outcome:   outcome,
+		Reason:    reason,
+		Trace:     trace,
+		Raw:       string(raw),
+	}
+	for _, script := range trace.Scripts {
+		if !slices.Contains(record.Scripts, script.Name) {
+			record.Scripts = append(record.Scripts, script.Name)
+		}
+	}
+	return &record
+}
+
+// History is the trace history database.  It is opened for each operation
+// so the search command can read it while the daemon is running.
+type History struct {
+	Filename string
+	mutex    sync.Mutex
+}
+
+func NewHistory(filename string) *History {
+	return &History{Filename: filename}
+}
+
+func (h *History) open(readOnly bool) (*bolt.DB, error) {
+	if !readOnly {
+		err := os.MkdirAll(filepath.Dir(h.Filename), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bolt.Open(h.Filename, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+}
+
+func (h *History) update(fn func(tx *bolt.Tx) error) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	db, err := h.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (h *History) view(fn func(tx *bolt.Tx) error) error {
+	if !IsFile(h.Filename) {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	db, err := h.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// historyKey returns a record key ordered by time
+func historyKey(t time.Time, sequence uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], sequence)
+	return key
+}
+
+func indexKey(value string, id []byte) []byte {
+	return append([]byte(strings.ToLower(value)+"\x00"), id...)
+}
+
+// Add stores a record and its index entries, setting the record ID
+func (h *History) Add(record *HistoryRecord) error {
+	return h.update(func(tx *bolt.Tx) error {
+		records, err := tx.CreateBucketIfNotExists(HISTORY_RECORDS)
+		if err != nil {
+			return err
+		}
+		sequence, err := records.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := historyKey(record.Time, sequence)
+		record.ID = hex.EncodeToString(key)
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = records.Put(key, data)
+		if err != nil {
+			return err
+		}
+		for name, values := range HISTORY_INDEXES {
+			index, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for _, value := range values(record) {
+				if value == "" {
+					continue
+				}
+				err = index.Put(indexKey(value, key), nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the record with the given id, or nil if there is none
+func (h *History) Get(id string) (*HistoryRecord, error) {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid history id: %s", id)
+	}
+	var record *HistoryRecord
+	err = h.view(func(tx *bolt.Tx) error {
+		records := tx.Bucket(HISTORY_RECORDS)
+		if records == nil {
+			return nil
+		}
+		data := records.Get(key)
+		if data == nil {
+			return nil
+		}
+		record = &HistoryRecord{}
+		return json.Unmarshal(data, record)
+	})
+	return record, err
+}
+
+// Prune removes records older than cutoff and their index entries
+func (h *History) Prune(cutoff time.Time) (int, error) {
+	removed := 0
+	err := h.update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(HISTORY_RECORDS)
+		if records == nil {
+			return nil
+		}
+		end := historyKey(cutoff, 0)
+		cursor := records.Cursor()
+		for key, data := cursor.First(); key != nil && bytes.Compare(key, end) < 0; key, data = cursor.First() {
+			var record HistoryRecord
+			err := json.Unmarshal(data, &record)
+			if err != nil {
+				return err
+			}
+			for name, values := range HISTORY_INDEXES {
+				index := tx.Bucket([]byte(name))
+				if index == nil {
+					continue
+				}
+				for _, value := range values(&record) {
+					err = index.Delete(indexKey(value, key))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			err = records.Delete(key)
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// HistoryQuery selects records; patterns are shell globs matched without
+// regard to case and empty fields match everything
+type HistoryQuery struct {
+	Username  string
+	Sender    string
+	Recipient string
+	Script    string
+	Action    string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && matched
+}
+
+func (q *HistoryQuery) match(record *HistoryRecord) bool {
+	if q.Username != "" && q.Username != record.Username {
+		return false
+	}
+	if !globMatch(q.Sender, record.Sender) || !globMatch(q.Recipient, record.Recipient) {
+		return false
+	}
+	if q.Script != "" && !slices.Contains(record.Scripts, q.Script) {
+		return false
+	}
+	if q.Action != "" && !slices.ContainsFunc(record.Actions, func(action string) bool { return globMatch(q.Action, action) }) {
+		return false
+	}
+	if q.Outcome != "" && q.Outcome != record.Outcome {
+		return false
+	}
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// index returns the index and value to narrow a search by, preferring the
+// user, then exact sender and script values
+func (q *HistoryQuery) index() (string, string) {
+	switch {
+	case q.Username != "":
+		return "user", q.Username
+	case q.Sender != "" && !strings.ContainsAny(q.Sender, "*?["):
+		return "sender", q.Sender
+	case q.Script != "":
+		return "script", q.Script
+	}
+	return "", ""
+}
+
+// Search returns the matching records, newest first
+func (h *History) Search(q *HistoryQuery) ([]*HistoryRecord, error) {
+	found := []*HistoryRecord{}
+	add := func(data []byte) (bool, error) {
+		var record HistoryRecord
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return false, err
+		}
+		if q.match(&record) {
+			found = append(found, &record)
+		}
+		return q.Limit > 0 && len(found) >= q.Limit, nil
+	}
+	err := h.view(func(tx *bolt.Tx) error {
+		records := tx.Bucket(HISTORY_RECORDS)
+		if records == nil {
+			return nil
+		}
+		name, value := q.index()
+		if name == "" {
+			cursor := records.Cursor()
+			for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+				if !q.Since.IsZero() && bytes.Compare(key, historyKey(q.Since, 0)) < 0 {
+					break
+				}
+				done, err := add(data)
+				if err != nil || done {
+					return err
+				}
+			}
+			return nil
+		}
+		index := tx.Bucket([]byte(name))
+		if index == nil {
+			return nil
+		}
+		prefix := indexKey(value, nil)
+		cursor := index.Cursor()
+		// position after the last entry for the value and walk back
+		key, _ := cursor.Seek([]byte(strings.ToLower(value) + "\x01"))
+		if key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Prev() {
+			id := key[len(prefix):]
+			if !q.Since.IsZero() && bytes.Compare(id, historyKey(q.Since, 0)) < 0 {
+				break
+			}
+			done, err := add(records.Get(id))
+			if err != nil || done {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// recordHistory stores a processed trace; failures are logged since the
+// history must not hold up delivery
+func (t *TraceFile) recordHistory(m *Monitor, outcome string) {
+	if m.history == nil || t.trace == nil {
+		return
+	}
+	raw, err := os.ReadFile(t.Filename)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("failed reading trace for history", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+		return
+	}
+	err = m.history.Add(NewHistoryRecord(t.Username, t.trace, raw, outcome, t.reason))
+	if err != nil {
+		slog.Error("failed recording history", LOG_USER, t.Username, LOG_FILE, m.history.Filename, "error", err)
+	}
+}
+
+func writeHistoryTable(w io.Writer, records []*HistoryRecord) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTIME\tUSER\tSENDER\tSUBJECT\tOUTCOME\tACTIONS")
+	for _, r := range records {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Time.Local().Format("2006-01-02 15:04:05"), r.Username, r.Sender, r.Subject, r.Outcome, strings.Join(r.Actions, "; "))
+	}
+	return table.Flush()
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "search processed traces",
+	Long: `
+Query the history of processed traces.  Every trace the daemon handles
+is stored with its parsed form, raw text and outcome in history_file.
+`,
+}
+
+var historySearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "list traces matching the given fields",
+	Long: `
+List stored traces, newest first.  --sender, --recipient and --action
+take shell patterns such as '*@example.com'; --since and --until take a
+duration before now such as 24h.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		setConfigDefaults()
+		query := HistoryQuery{
+			Username:  viper.GetString("history.user"),
+			Sender:    viper.GetString("history.sender"),
+			Recipient: viper.GetString("history.recipient"),
+			Script:    viper.GetString("history.script"),
+			Action:    viper.GetString("history.action"),
+			Outcome:   viper.GetString("history.outcome"),
+			Limit:     viper.GetInt("history.limit"),
+		}
+		for name, field := range map[string]*time.Time{"history.since": &query.Since, "history.until": &query.Until} {
+			if viper.GetString(name) == "" {
+				continue
+			}
+			duration, err := time.ParseDuration(viper.GetString(name))
+			cobra.CheckErr(err)
+			*field = time.Now().Add(-duration)
+		}
+		records, err := NewHistory(viper.GetString("history_file")).Search(&query)
+		cobra.CheckErr(err)
+		switch viper.GetString("history.format") {
+		case "table", "":
+			err = writeHistoryTable(os.Stdout, records)
+			cobra.CheckErr(err)
+		case "json":
+			fmt.Println(FormatJSON(records))
+		default:
+			cobra.CheckErr(fmt.Errorf("unknown format: %s", viper.GetString("history.format")))
+		}
+	},
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show ID",
+	Short: "show a stored trace",
+	Long: `
+Output the summary and raw text of the stored trace with the given ID.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setConfigDefaults()
+		record, err := NewHistory(viper.GetString("history_file")).Get(args[0])
+		cobra.CheckErr(err)
+		if record == nil {
+			cobra.CheckErr(fmt.Errorf("no history record: %s", args[0]))
+		}
+		fmt.Printf("time: %s\noutcome: %s %s\n", record.Time.Local().Format(time.RFC3339), record.Outcome, record.Reason)
+		writeTraceSummary(os.Stdout, record.Trace)
+		fmt.Print(record.Raw)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historySearchCmd)
+	historyCmd.AddCommand(historyShowCmd)
+	for _, flag := range [][2]string{
+		{"user", "username"},
+		{"sender", "envelope sender pattern"},
+		{"recipient", "final recipient pattern"},
+		{"script", "name of a script that ran"},
+		{"action", "final action pattern"},
+		{"outcome", "outcome (forwarded, skipped, held, rejected, duplicate)"},
+		{"since", "only traces newer than this duration"},
+		{"until", "only traces older than this duration"},
+	} {
+		historySearchCmd.Flags().String(flag[0], "", flag[1])
+		viper.BindPFlag("history."+flag[0], historySearchCmd.Flags().Lookup(flag[0]))
+	}
+	historySearchCmd.Flags().Int("limit", DEFAULT_HISTORY_LIMIT, "maximum records listed (0 lists all)")
+	viper.BindPFlag("history.limit", historySearchCmd.Flags().Lookup("limit"))
+	historySearchCmd.Flags().String("format", "table", "output format (table, json)")
+	viper.BindPFlag("history.format", historySearchCmd.Flags().Lookup("format"))
+}
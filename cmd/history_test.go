@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func addHistory(t *testing.T, h *History, username, filename string, when time.Time) *HistoryRecord {
+	trace, err := ParseTrace(filename)
+	require.Nil(t, err)
+	raw, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	record := NewHistoryRecord(username, trace, raw, HISTORY_FORWARDED, "message_delivery_trace")
+	record.Time = when
+	require.Nil(t, h.Add(record))
+	return record
+}
+
+func TestHistorySearch(t *testing.T) {
+	h := NewHistory(filepath.Join(t.TempDir(), "history.db"))
+	now := time.Now()
+	old := addHistory(t, h, "mkrueger", "testdata/delivery.trace", now.Add(-48*time.Hour))
+	thread := addHistory(t, h, "mkrueger", "testdata/thread.trace", now.Add(-time.Hour))
+	actions := addHistory(t, h, "alice", "testdata/actions.trace", now)
+
+	ids := func(q HistoryQuery) []string {
+		records, err := h.Search(&q)
+		require.Nil(t, err)
+		found := []string{}
+		for _, record := range records {
+			found = append(found, record.ID)
+		}
+		return found
+	}
+	require.Equal(t, []string{actions.ID, thread.ID, old.ID}, ids(HistoryQuery{}))
+	require.Equal(t, []string{thread.ID, old.ID}, ids(HistoryQuery{Username: "mkrueger"}))
+	require.Equal(t, []string{thread.ID}, ids(HistoryQuery{Username: "mkrueger", Since: now.Add(-24 * time.Hour)}))
+	require.Equal(t, []string{thread.ID}, ids(HistoryQuery{Sender: "*@EXAMPLE.com"}))
+	require.Equal(t, []string{thread.ID}, ids(HistoryQuery{Sender: "alice@example.com"}))
+	require.Equal(t, []string{old.ID}, ids(HistoryQuery{Script: "ignore-daemons"}))
+	require.Equal(t, []string{actions.ID}, ids(HistoryQuery{Action: "*Lists*"}))
+	require.Equal(t, []string{actions.ID}, ids(HistoryQuery{Limit: 1}))
+	require.Empty(t, ids(HistoryQuery{Username: "nobody"}))
+
+	record, err := h.Get(actions.ID)
+	require.Nil(t, err)
+	require.Equal(t, "news@lists.example.org", record.Sender)
+	require.Equal(t, "mkrueger", record.Recipient)
+	require.Equal(t, []string{"new-mail"}, record.Scripts)
+	require.Contains(t, record.Raw, "fileinto action")
+
+	removed, err := h.Prune(now.Add(-24 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []string{thread.ID}, ids(HistoryQuery{Username: "mkrueger"}))
+	require.Empty(t, ids(HistoryQuery{Script: "ignore-daemons"}))
+}
+
+func TestHistoryMissing(t *testing.T) {
+	h := NewHistory(filepath.Join(t.TempDir(), "history.db"))
+	records, err := h.Search(&HistoryQuery{Username: "alice"})
+	require.Nil(t, err)
+	require.Empty(t, records)
+}
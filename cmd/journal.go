@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const JOURNAL_SENDING = "sending"
+const JOURNAL_SENT = "sent"
+
+// JOURNAL_FAILED ends an attempt that will not be retried, such as a
+// rejected webhook or an unusable encryption key
+const JOURNAL_FAILED = "failed"
+
+type JournalEntry struct {
+	Key      string    `json:"key"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+	Username string    `json:"user"`
+	Filename string    `json:"file"`
+}
+
+// DeliveryJournal is an append-only log of delivery state keyed by trace
+// file identity, so a trace sent before a crash is not sent again
+type DeliveryJournal struct {
+	Filename string
+	entries  map[string]*JournalEntry
+	file     *os.File
+	mutex    sync.Mutex
+}
+
+func OpenJournal(filename string) (*DeliveryJournal, error) {
+	j := DeliveryJournal{
+		Filename: filename,
+		entries:  make(map[string]*JournalEntry),
+	}
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = j.load()
+	if err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (j *DeliveryJournal) load() error {
+	file, err := os.Open(j.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// a torn final line from a crash is expected; skip it
+			continue
+		}
+		j.entries[entry.Key] = &entry
+	}
+	return scanner.Err()
+}
+
+// State returns the last recorded state for key, or "" if unknown
+func (j *DeliveryJournal) State(key string) string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry, ok := j.entries[key]
+	if !ok {
+		return ""
+	}
+	return entry.State
+}
+
+// Record appends a state change for key and syncs it to disk
+func (j *DeliveryJournal) Record(key, state, username, filename string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry := JournalEntry{
+		Key:      key,
+		State:    state,
+		Time:     time.Now(),
+		Username: username,
+		Filename: filename,
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return err
+	}
+	j.entries[key] = &entry
+	return nil
+}
+
+// Compact rewrites the journal keeping only entries newer than retention;
+// the entries in memory are replaced only once the new file is in place,
+// so a failed write leaves both the journal and its state unchanged
+func (j *DeliveryJournal) Compact(retention time.Duration) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	cutoff := time.Now().Add(-retention)
+	kept := make(map[string]*JournalEntry)
+	for key, entry := range j.entries {
+		if !entry.Time.Before(cutoff) {
+			kept[key] = entry
+		}
+	}
+	tmpFile := j.Filename + ".tmp"
+	err := writeJournal(tmpFile, kept)
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+	err = os.Rename(tmpFile, j.Filename)
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+	err = syncDir(filepath.Dir(j.Filename))
+	if err != nil {
+		return 0, err
+	}
+	removed := len(j.entries) - len(kept)
+	j.entries = kept
+	file, err := os.OpenFile(j.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	j.file.Close()
+	j.file = file
+	return removed, nil
+}
+
+// writeJournal writes entries to a new file and syncs it
+func writeJournal(filename string, entries map[string]*JournalEntry) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir flushes a directory, making a rename within it durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (j *DeliveryJournal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+// FileIdentity returns a key built from the device, inode, size and
+// content hash of filename
+func FileIdentity(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unsupported file stat for %s", filename)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d:%d:%s", sys.Dev, sys.Ino, stat.Size(), hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeliveryJournal(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "journal.log")
+	trace := filepath.Join(dir, "test.trace")
+	require.Nil(t, os.WriteFile(trace, []byte("Sieve trace log for message delivery:\n"), 0600))
+
+	key, err := FileIdentity(trace)
+	require.Nil(t, err)
+
+	journal, err := OpenJournal(filename)
+	require.Nil(t, err)
+	require.Equal(t, "", journal.State(key))
+	require.Nil(t, journal.Record(key, JOURNAL_SENDING, "alice", trace))
+	require.Nil(t, journal.Record(key, JOURNAL_SENT, "alice", trace))
+	require.Nil(t, journal.Close())
+
+	// state survives a restart
+	journal, err = OpenJournal(filename)
+	require.Nil(t, err)
+	require.Equal(t, JOURNAL_SENT, journal.State(key))
+
+	// changed content yields a new identity
+	require.Nil(t, os.WriteFile(trace, []byte("Sieve trace log for IMAPSIEVE:\n"), 0600))
+	otherKey, err := FileIdentity(trace)
+	require.Nil(t, err)
+	require.NotEqual(t, key, otherKey)
+
+	removed, err := journal.Compact(time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, 0, removed)
+	require.Equal(t, JOURNAL_SENT, journal.State(key))
+
+	removed, err = journal.Compact(0)
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, "", journal.State(key))
+	require.Nil(t, journal.Close())
+}
+
+func TestDeliveryJournalCompactFailure(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "journal.log")
+	journal, err := OpenJournal(filename)
+	require.Nil(t, err)
+	defer journal.Close()
+	require.Nil(t, journal.Record("key", JOURNAL_SENT, "alice", "test.trace"))
+
+	// the temporary file cannot be created
+	require.Nil(t, os.Mkdir(filename+".tmp", 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(filename+".tmp", "busy"), nil, 0600))
+	_, err = journal.Compact(0)
+	require.NotNil(t, err)
+	require.Equal(t, JOURNAL_SENT, journal.State("key"))
+
+	reopened, err := OpenJournal(filename)
+	require.Nil(t, err)
+	defer reopened.Close()
+	require.Equal(t, JOURNAL_SENT, reopened.State("key"))
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// journaldHandler sends each record to the journal using the native
+// datagram protocol, with every attribute as a separate journal field
+type journaldHandler struct {
+	conn       *net.UnixConn
+	identifier string
+	options    slog.HandlerOptions
+	prefix     string
+	fields     [][2]string
+}
+
+func newJournaldHandler(socket, identifier string, options *slog.HandlerOptions) (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	h := journaldHandler{
+		conn:       conn,
+		identifier: identifier,
+		options:    *options,
+	}
+	return &h, nil
+}
+
+func (h *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.options.Level != nil {
+		minLevel = h.options.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", r.Message)
+	journalField(&buf, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", h.identifier)
+	if h.options.AddSource && r.PC != 0 {
+		frames := runtime.CallersFrames([]uintptr{r.PC})
+		frame, _ := frames.Next()
+		journalField(&buf, "CODE_FILE", frame.File)
+		journalField(&buf, "CODE_LINE", strconv.Itoa(frame.Line))
+		journalField(&buf, "CODE_FUNC", frame.Function)
+	}
+	for _, field := range h.fields {
+		journalField(&buf, field[0], field[1])
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		for _, field := range flattenAttr(h.prefix, a) {
+			journalField(&buf, field[0], field[1])
+		}
+		return true
+	})
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.fields = append([][2]string{}, h.fields...)
+	for _, a := range attrs {
+		c.fields = append(c.fields, flattenAttr(h.prefix, a)...)
+	}
+	return &c
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "_"
+	return &c
+}
+
+func (h *journaldHandler) Close() error {
+	return h.conn.Close()
+}
+
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func flattenAttr(prefix string, a slog.Attr) [][2]string {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		fields := [][2]string{}
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix = prefix + a.Key + "_"
+		}
+		for _, ga := range value.Group() {
+			fields = append(fields, flattenAttr(groupPrefix, ga)...)
+		}
+		return fields
+	}
+	if a.Key == "" {
+		return nil
+	}
+	return [][2]string{{journalKey(prefix + a.Key), value.String()}}
+}
+
+// journalKey maps an attribute key onto the journal field name rules:
+// uppercase letters, digits and underscores, not starting with an underscore
+func journalKey(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "X" + name
+	}
+	return name
+}
+
+func journalField(buf *bytes.Buffer, key, value string) {
+	if strings.Contains(value, "\n") {
+		// multi-line values use the explicit length encoding
+		buf.WriteString(key)
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	fmt.Fprintf(buf, "%s=%s\n", key, value)
+}
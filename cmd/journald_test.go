@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournaldHandler(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.socket")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.Nil(t, err)
+	defer listener.Close()
+
+	handler, err := newJournaldHandler(socket, "sieve-monitor", &slog.HandlerOptions{Level: slog.LevelInfo})
+	require.Nil(t, err)
+	defer handler.Close()
+
+	logger := slog.New(handler).With(LOG_USER, "alice")
+	logger.Debug("hidden")
+	logger.Warn("skipping", LOG_FILE, "/home/alice/sieve_trace/x.trace", LOG_REASON, "sender_is_daemon")
+
+	buf := make([]byte, 4096)
+	n, err := listener.Read(buf)
+	require.Nil(t, err)
+	fields := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+	require.Contains(t, fields, "MESSAGE=skipping")
+	require.Contains(t, fields, "PRIORITY=4")
+	require.Contains(t, fields, "SYSLOG_IDENTIFIER=sieve-monitor")
+	require.Contains(t, fields, "USER=alice")
+	require.Contains(t, fields, "FILE=/home/alice/sieve_trace/x.trace")
+	require.Contains(t, fields, "REASON=sender_is_daemon")
+}
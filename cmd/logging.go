@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// structured log field keys used on every event
+const LOG_USER = "user"
+const LOG_FILE = "file"
+const LOG_REASON = "reason"
+const LOG_RULE = "rule"
+const LOG_MESSAGE_ID = "message_id"
+const LOG_DURATION = "duration"
+
+const DEFAULT_LOG_LEVEL = "info"
+const DEFAULT_LOG_FORMAT = "text"
+const DEFAULT_DAEMON_LOGFILE = "/var/log/sieve-monitor"
+const DEFAULT_SYSLOG_FACILITY = "daemon"
+
+var LogFile *os.File
+var logCloser io.Closer
+
+func OpenLog() {
+	err := openLog()
+	if err != nil {
+		Fatal("failed opening log", "error", err)
+	}
+}
+
+// openLog sets the default logger to the configured target, leaving the
+// current logger in place if the target cannot be opened
+func openLog() error {
+	filename := viper.GetString("logfile")
+
+	level, err := logLevel()
+	if err != nil {
+		return err
+	}
+	options := slog.HandlerOptions{
+		Level:     level,
+		AddSource: viper.GetBool("debug"),
+	}
+
+	_, name := filepath.Split(os.Args[0])
+
+	var handler slog.Handler
+	var output io.Writer
+	var file *os.File
+	var closer io.Closer
+	switch filename {
+	case "stdout", "-":
+		output = os.Stdout
+	case "stderr":
+		output = os.Stderr
+	case "syslog":
+		h, err := newSyslogHandler(syslogTag(name), viper.GetString("syslog_facility"), &options)
+		if err != nil {
+			return fmt.Errorf("failed opening syslog: %v", err)
+		}
+		closer = h
+		handler = h
+	case "journald":
+		h, err := newJournaldHandler(JOURNALD_SOCKET, syslogTag(name), &options)
+		if err != nil {
+			return fmt.Errorf("failed opening journald: %v", err)
+		}
+		closer = h
+		handler = h
+	default:
+		if logRotationEnabled() {
+			rotator := newRotatingLog(filename)
+			closer = rotator
+			output = rotator
+			break
+		}
+		file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return fmt.Errorf("failed opening log file %s: %v", filename, err)
+		}
+		output = file
+	}
+
+	if handler == nil {
+		switch viper.GetString("log_format") {
+		case "json":
+			handler = slog.NewJSONHandler(output, &options)
+		case "text", "":
+			handler = slog.NewTextHandler(output, &options)
+		default:
+			if closer != nil {
+				closer.Close()
+			}
+			if file != nil {
+				file.Close()
+			}
+			return fmt.Errorf("unknown log_format: %s", viper.GetString("log_format"))
+		}
+	}
+
+	LogFile = file
+	logCloser = closer
+	logger := slog.New(handler).With("program", name, "pid", os.Getpid())
+	slog.SetDefault(logger)
+	return nil
+}
+
+// ReopenLog replaces the log handler with one writing to a freshly opened
+// log target, so externally rotated files are released; if the target
+// cannot be opened the current log is kept
+func ReopenLog() {
+	oldFile := LogFile
+	oldCloser := logCloser
+	err := openLog()
+	if err != nil {
+		slog.Error("failed reopening log, keeping current log", "error", err)
+		return
+	}
+	if oldCloser != nil {
+		err := oldCloser.Close()
+		if err != nil {
+			slog.Warn("failed closing previous log", "error", err)
+		}
+	}
+	if oldFile != nil {
+		err := oldFile.Close()
+		if err != nil {
+			slog.Warn("failed closing previous log file", LOG_FILE, oldFile.Name(), "error", err)
+		}
+	}
+	slog.Info("log reopened", LOG_FILE, viper.GetString("logfile"))
+}
+
+// logRotationEnabled returns true when a size or time limit is configured;
+// log_max_age_days alone only prunes rotated files and does not rotate
+func logRotationEnabled() bool {
+	return viper.GetInt("log_max_size_mb") > 0 || viper.GetInt("log_rotate_hours") > 0
+}
+
+// rotatingLog is a lumberjack logger that is also rotated every
+// log_rotate_hours, since lumberjack itself only rotates by size
+type rotatingLog struct {
+	*lumberjack.Logger
+	stop chan struct{}
+}
+
+func newRotatingLog(filename string) *rotatingLog {
+	maxSize := viper.GetInt("log_max_size_mb")
+	if maxSize <= 0 {
+		// lumberjack treats 0 as 100MB; rotate by time only
+		maxSize = math.MaxInt32
+	}
+	r := rotatingLog{
+		Logger: &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    maxSize,
+			MaxAge:     viper.GetInt("log_max_age_days"),
+			MaxBackups: viper.GetInt("log_max_backups"),
+			Compress:   viper.GetBool("log_compress"),
+		},
+		stop: make(chan struct{}),
+	}
+	hours := viper.GetInt("log_rotate_hours")
+	if hours > 0 {
+		go r.rotate(time.Duration(hours) * time.Hour)
+	}
+	return &r
+}
+
+func (r *rotatingLog) rotate(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			err := r.Rotate()
+			if err != nil {
+				slog.Error("log rotation failed", LOG_FILE, r.Filename, "error", err)
+			}
+		}
+	}
+}
+
+func (r *rotatingLog) Close() error {
+	close(r.stop)
+	return r.Logger.Close()
+}
+
+// DaemonLogFile returns the file the daemon redirects stdout and stderr to;
+// when logging to a file, that file is used so panics land next to the log.
+// A rotated log is not held open by stderr, so panics go to a separate
+// file beside it.
+func DaemonLogFile() string {
+	switch viper.GetString("logfile") {
+	case "stdout", "-", "stderr":
+		return DEFAULT_DAEMON_LOGFILE
+	case "syslog", "journald":
+		return ""
+	}
+	if logRotationEnabled() {
+		return viper.GetString("logfile") + ".stderr"
+	}
+	return viper.GetString("logfile")
+}
+
+func syslogTag(name string) string {
+	tag := viper.GetString("syslog_tag")
+	if tag == "" {
+		return name
+	}
+	return tag
+}
+
+// logLevel returns the configured level; the debug and verbose switches
+// lower the level to debug regardless of the log_level setting
+func logLevel() (slog.Level, error) {
+	if viper.GetBool("debug") || viper.GetBool("verbose") {
+		return slog.LevelDebug, nil
+	}
+	var level slog.Level
+	name := viper.GetString("log_level")
+	if name == "" {
+		name = DEFAULT_LOG_LEVEL
+	}
+	err := level.UnmarshalText([]byte(strings.ToUpper(name)))
+	if err != nil {
+		return level, fmt.Errorf("unknown log_level: %s", name)
+	}
+	return level, nil
+}
+
+func CloseLog() {
+	if logCloser != nil {
+		err := logCloser.Close()
+		cobra.CheckErr(err)
+		logCloser = nil
+	}
+	if LogFile != nil {
+		err := LogFile.Close()
+		cobra.CheckErr(err)
+		LogFile = nil
+	}
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	CloseLog()
+	os.Exit(1)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogLevel(t *testing.T) {
+	defer viper.Set("log_level", DEFAULT_LOG_LEVEL)
+
+	viper.Set("log_level", "warn")
+	level, err := logLevel()
+	require.Nil(t, err)
+	require.Equal(t, slog.LevelWarn, level)
+
+	viper.Set("verbose", true)
+	level, err = logLevel()
+	require.Nil(t, err)
+	require.Equal(t, slog.LevelDebug, level)
+
+	viper.Set("verbose", false)
+	viper.Set("log_level", "noisy")
+	_, err = logLevel()
+	require.NotNil(t, err)
+}
+
+func TestReopenLog(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sieve-monitor.log")
+	viper.Set("logfile", filename)
+	defer func() {
+		viper.Set("logfile", "stderr")
+		ReopenLog()
+	}()
+	OpenLog()
+	slog.Info("before rotation")
+
+	rotated := filename + ".1"
+	require.Nil(t, os.Rename(filename, rotated))
+	ReopenLog()
+	slog.Info("after rotation")
+
+	data, err := os.ReadFile(rotated)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "before rotation")
+	data, err = os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "after rotation")
+	require.NotContains(t, string(data), "before rotation")
+}
+
+func TestReopenLogFailure(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sieve-monitor.log")
+	viper.Set("logfile", filename)
+	defer func() {
+		viper.Set("logfile", "stderr")
+		ReopenLog()
+	}()
+	OpenLog()
+
+	// an unwritable target keeps the current log instead of exiting
+	viper.Set("logfile", filepath.Join(dir, "missing", "sieve-monitor.log"))
+	ReopenLog()
+	slog.Info("after failed reopen")
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "failed reopening log")
+	require.Contains(t, string(data), "after failed reopen")
+}
+
+func TestRotatingLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sieve-monitor.log")
+	defer viper.Set("logfile", "stderr")
+	viper.Set("logfile", filename)
+	require.Equal(t, filename, DaemonLogFile())
+	defer viper.Set("log_rotate_hours", 0)
+	viper.Set("log_rotate_hours", 24)
+	require.True(t, logRotationEnabled())
+	require.Equal(t, filename+".stderr", DaemonLogFile())
+
+	rotator := newRotatingLog(filename)
+	_, err := rotator.Write([]byte("before rotation\n"))
+	require.Nil(t, err)
+	go rotator.rotate(10 * time.Millisecond)
+	require.Eventually(t, func() bool {
+		backups, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), "sieve-monitor-*.log"))
+		return len(backups) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, rotator.Close())
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const MONITOR_ID_PREFIX = "smid-"
+const DEFAULT_LOOP_WINDOW_MINUTES = 60
+
+// NewMonitorID returns a unique value for the X-Sieve-Monitor-Id header
+func NewMonitorID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return MONITOR_ID_PREFIX + hex.EncodeToString(buf)
+}
+
+// RecentSends remembers the Message-IDs of recently forwarded traces, so a
+// trace of the delivery of our own message can be recognised
+type RecentSends struct {
+	Window   time.Duration
+	messages map[string]time.Time
+	mutex    sync.Mutex
+}
+
+func NewRecentSends(window time.Duration) *RecentSends {
+	return &RecentSends{
+		Window:   window,
+		messages: make(map[string]time.Time),
+	}
+}
+
+func (r *RecentSends) Record(messageID string) {
+	if r == nil || messageID == "" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	r.expire(now)
+	r.messages[messageID] = now
+}
+
+func (r *RecentSends) HasMessage(messageID string) bool {
+	if r == nil || messageID == "" {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(time.Now())
+	_, found := r.messages[messageID]
+	return found
+}
+
+func (r *RecentSends) expire(now time.Time) {
+	cutoff := now.Add(-r.Window)
+	for key, sent := range r.messages {
+		if sent.Before(cutoff) {
+			delete(r.messages, key)
+		}
+	}
+}
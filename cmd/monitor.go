@@ -1,15 +1,19 @@
 package cmd
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/spf13/viper"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
-	"slices"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,254 +22,528 @@ const DEFAULT_MIN_UID = 1000
 const DEFAULT_SCAN_SECONDS = 5
 const DEFAULT_STABILIZE_SECONDS = 1
 const DEFAULT_STABILIZE_COUNT = 5
+const DEFAULT_SHUTDOWN_TIMEOUT_SECONDS = 30
+const DEFAULT_STATE_FILE = "/var/lib/sieve-monitor/state.json"
+const DEFAULT_STATE_SAVE_SECONDS = 60
+const DEFAULT_DELIVERY_WORKERS = 4
+const DEFAULT_DELIVERY_QUEUE_SIZE = 16
+const DEFAULT_JOURNAL_FILE = "/var/lib/sieve-monitor/journal.log"
+const DEFAULT_JOURNAL_RETENTION_HOURS = 168
+const DEFAULT_JOURNAL_COMPACT_HOURS = 24
+const TRACE_DIR = "sieve_trace"
 
 var TRACE_PATTERN_MESSAGE = regexp.MustCompile(`^\s*Sieve trace log for message delivery:`)
 var TRACE_PATTERN_DAEMON = regexp.MustCompile(`^\s*Sender:.*<[A-Z]+-DAEMON@.*>`)
 var TRACE_PATTERN_EXECUTE = regexp.MustCompile(`^\s*## Started executing`)
 
 type TraceFile struct {
-	Username string
-	Filename string
-	Size     int64
-	Count    int
+	Username  string
+	Filename  string
+	Size      int64
+	Count     int
+	FirstSeen time.Time
+	Queued    bool `json:"-"`
+	trace     *Trace
+	reason    string
+	failures  int
+	retryAt   time.Time
 }
 
 type Monitor struct {
-	ScanSeconds      int
-	StabilizeSeconds int
-	StabilizeCount   int
-	MinUID           int
-	SkipUsers        []string
-	Domain           string
-	UserHomes        map[string]string
-	TraceFiles       map[string]*TraceFile
-	Verbose          bool
-	stop             chan struct{}
+	ScanSeconds        int
+	StabilizeSeconds   int
+	StabilizeCount     int
+	StabilizeStrategy  []string
+	StabilizeMtime     time.Duration
+	ShutdownTimeout    time.Duration
+	DeliveryWorkers    int
+	DeliveryQueueSize  int
+	DigestDir          string
+	DigestInterval     time.Duration
+	StateFile          string
+	StateSave          time.Duration
+	JournalFile        string
+	JournalRetention   time.Duration
+	JournalCompact     time.Duration
+	HistoryFile        string
+	HistoryRetention   time.Duration
+	HTTPListen         string
+	HTTPHtpasswd       string
+	HTTPProxyHeader    string
+	HTTPTrustedProxies []string
+	HTTPAdmins         []string
+	TracingFile        string
+	TracingCheck       time.Duration
+	TracingMaxAge      time.Duration
+	MinUID             int
+	SkipUsers          []string
+	Domain             string
+	UserHomes          map[string]string
+	TraceFiles         map[string]*TraceFile
+	Transport          string
+	Verbose            bool
+	Watchdog           time.Duration
+	journal            *DeliveryJournal
+	history            *History
+	webhook            *Webhook
+	limiter            *RateLimiter
+	recent             *RecentSends
+	background         sync.WaitGroup
+	digesting          atomic.Bool
+	traceDirs          map[string]bool
+	reload             chan struct{}
 }
 
 func NewMonitor() *Monitor {
-	log.Printf("version %s startup\n", Version)
-	viper.SetDefault("scan_interval_seconds", DEFAULT_SCAN_SECONDS)
-	viper.SetDefault("stabilize_interval_seconds", DEFAULT_STABILIZE_SECONDS)
-	viper.SetDefault("stabilize_count", DEFAULT_STABILIZE_COUNT)
-	viper.SetDefault("skip_users", DEFAULT_SKIP_USERS)
-	viper.SetDefault("min_uid", DEFAULT_MIN_UID)
-	hostname, err := os.Hostname()
+	slog.Info("startup", "version", Version)
+	setConfigDefaults()
+	_, err := configDomain()
 	if err != nil {
-		log.Fatal(err)
+		Fatal("failed setting domain", "error", err)
 	}
-	_, domain, found := strings.Cut(hostname, ".")
-	if !found {
-		log.Fatalf("failed parsing domain from '%s'", hostname)
+	signer, err := LoadDKIMSigner()
+	if err != nil {
+		Fatal("invalid dkim configuration", "error", err)
+	}
+	Signer = signer
+	strategy, err := parseStabilizeStrategy(viper.GetString("stabilize_strategy"))
+	if err != nil {
+		Fatal("invalid configuration", "error", err)
 	}
-	viper.SetDefault("domain", domain)
 	monitor := Monitor{
-		ScanSeconds:      viper.GetInt("scan_interval_seconds"),
-		StabilizeSeconds: viper.GetInt("stabilize_interval_seconds"),
-		StabilizeCount:   viper.GetInt("stabilize_count"),
-		TraceFiles:       make(map[string]*TraceFile),
-		MinUID:           viper.GetInt("min_uid"),
-		SkipUsers:        strings.Split(viper.GetString("skip_users"), ","),
-		Domain:           viper.GetString("domain"),
-		UserHomes:        make(map[string]string),
-		Verbose:          viper.GetBool("verbose"),
-		stop:             make(chan struct{}),
+		ScanSeconds:        viper.GetInt("scan_interval_seconds"),
+		StabilizeSeconds:   viper.GetInt("stabilize_interval_seconds"),
+		StabilizeCount:     viper.GetInt("stabilize_count"),
+		StabilizeStrategy:  strategy,
+		StabilizeMtime:     time.Duration(viper.GetInt64("stabilize_mtime_ms")) * time.Millisecond,
+		ShutdownTimeout:    time.Duration(viper.GetInt64("shutdown_timeout_seconds")) * time.Second,
+		DeliveryWorkers:    viper.GetInt("delivery_workers"),
+		DeliveryQueueSize:  viper.GetInt("delivery_queue_size"),
+		DigestDir:          viper.GetString("digest_dir"),
+		DigestInterval:     time.Duration(viper.GetInt64("digest_interval_minutes")) * time.Minute,
+		StateFile:          viper.GetString("state_file"),
+		StateSave:          time.Duration(viper.GetInt64("state_save_seconds")) * time.Second,
+		JournalFile:        viper.GetString("journal_file"),
+		JournalRetention:   time.Duration(viper.GetInt64("journal_retention_hours")) * time.Hour,
+		JournalCompact:     time.Duration(viper.GetInt64("journal_compact_hours")) * time.Hour,
+		HistoryFile:        viper.GetString("history_file"),
+		HistoryRetention:   time.Duration(viper.GetInt64("history_retention_days")) * 24 * time.Hour,
+		HTTPListen:         viper.GetString("http_listen"),
+		HTTPHtpasswd:       viper.GetString("http_htpasswd"),
+		HTTPProxyHeader:    viper.GetString("http_proxy_header"),
+		HTTPTrustedProxies: strings.Split(viper.GetString("http_trusted_proxies"), ","),
+		HTTPAdmins:         strings.Split(viper.GetString("http_admins"), ","),
+		TracingFile:        viper.GetString("tracing_file"),
+		TracingCheck:       time.Duration(viper.GetInt64("tracing_check_seconds")) * time.Second,
+		TracingMaxAge:      time.Duration(viper.GetInt64("tracing_max_hours")) * time.Hour,
+		TraceFiles:         make(map[string]*TraceFile),
+		MinUID:             viper.GetInt("min_uid"),
+		SkipUsers:          strings.Split(viper.GetString("skip_users"), ","),
+		Domain:             viper.GetString("domain"),
+		UserHomes:          make(map[string]string),
+		Transport:          viper.GetString("transport"),
+		Verbose:            viper.GetBool("verbose"),
+		Watchdog:           WatchdogInterval(),
+		traceDirs:          make(map[string]bool),
+		recent:             NewRecentSends(time.Duration(viper.GetInt64("loop_window_minutes")) * time.Minute),
+		reload:             make(chan struct{}, 1),
 	}
-	monitor.initUserHomes()
-	if monitor.Verbose {
-		log.Printf("Monitor: %s\n", FormatJSON(&monitor))
+	if viper.GetInt("rate_limit_user_per_hour") > 0 || viper.GetInt("rate_limit_global_per_hour") > 0 {
+		monitor.limiter = NewRateLimiter(
+			viper.GetInt("rate_limit_user_per_hour"),
+			viper.GetInt("rate_limit_user_burst"),
+			viper.GetInt("rate_limit_global_per_hour"),
+			viper.GetInt("rate_limit_global_burst"),
+		)
+	}
+	switch monitor.Transport {
+	case TRANSPORT_SENDMAIL:
+	case TRANSPORT_WEBHOOK:
+		monitor.webhook, err = NewWebhook()
+		if err != nil {
+			Fatal("invalid webhook configuration", "error", err)
+		}
+	default:
+		Fatal("invalid configuration", "error", fmt.Errorf("unknown transport: %s", monitor.Transport))
 	}
+	monitor.initUserHomes()
+	slog.Debug("monitor", "config", FormatJSON(&monitor))
 	return &monitor
 }
 
-func (m *Monitor) initUserHomes() {
-	usernames := strings.Split(viper.GetString("usernames"), ",")
-	for _, username := range usernames {
-		username := strings.TrimSpace(username)
-		if username != "" {
-			home := filepath.Join("/home", username)
-			if IsDir(home) && !m.skipUsername(username) {
-				m.UserHomes[username] = home
-				if m.Verbose {
-					log.Printf("added user from config: %s\n", username)
-				}
-			}
-		}
+// configDomain returns the configured domain, defaulting it to the domain
+// part of the host name
+func configDomain() (string, error) {
+	domain := viper.GetString("domain")
+	if domain != "" {
+		return domain, nil
 	}
-
-	if len(m.UserHomes) == 0 {
-		m.initUserHomesFromPasswd()
+	domain, err := hostnameDomain()
+	if err != nil {
+		return "", err
 	}
+	viper.SetDefault("domain", domain)
+	return domain, nil
 }
 
-func (m *Monitor) skipUsername(username string) bool {
-	if slices.Contains(m.SkipUsers, username) {
-		return true
+// hostnameDomain returns the domain part of the host name
+func hostnameDomain() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
 	}
-	if strings.HasPrefix(username, "_") {
-		return true
+	_, domain, found := strings.Cut(hostname, ".")
+	if !found {
+		return "", fmt.Errorf("no domain in hostname: %s", hostname)
 	}
-	return false
+	return domain, nil
 }
 
-func (m *Monitor) initUserHomesFromPasswd() {
-	file, err := os.Open("/etc/passwd")
+// initUserHomes sets the watched users from the resolved candidates
+func (m *Monitor) initUserHomes() {
+	candidates, err := m.UserCandidates(PASSWD_FILE)
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Split(line, ":")
-		if len(fields) > 0 {
-			username := fields[0]
-			uid, err := strconv.Atoi(fields[2])
-			if err != nil {
-				log.Fatalf("failed uid int conversion: %v", err)
-			}
-			home := fields[5]
-			if uid >= m.MinUID && IsDir(home) && !m.skipUsername(username) {
-				m.UserHomes[username] = home
-				if m.Verbose {
-					log.Printf("added user from /etc/passwd: %s\n", username)
-				}
-			}
-		}
+		Fatal("failed reading passwd", LOG_FILE, PASSWD_FILE, "error", err)
 	}
-	err = scanner.Err()
-	if err != nil {
-		log.Fatal(err)
+	for _, candidate := range candidates {
+		if candidate.Included {
+			m.UserHomes[candidate.Username] = candidate.Home
+			slog.Debug("added user from "+candidate.Source, LOG_USER, candidate.Username)
+		}
 	}
 }
 
-func (m *Monitor) scanFiles() {
-	deleteKeys := []string{}
-	for key, file := range m.TraceFiles {
+// scanFiles is the stabilization stage; stable files are queued for
+// delivery oldest first, and a full queue defers the user's remaining
+// files to the next pass so per-user ordering holds.  Files waiting to
+// retry a failed webhook are left until their retry time.
+func (m *Monitor) scanFiles(ctx context.Context, pool *DeliveryPool) {
+	now := time.Now()
+	stable := []*TraceFile{}
+	for _, file := range m.TraceFiles {
+		if ctx.Err() != nil {
+			return
+		}
+		if file.Queued || now.Before(file.retryAt) {
+			continue
+		}
 		if file.scan(m) {
-			deleteKeys = append(deleteKeys, key)
+			stable = append(stable, file)
+		} else if _, found := m.TraceFiles[file.Filename]; !found {
+			pool.Unblock(file)
 		}
 	}
-	for _, key := range deleteKeys {
-		if m.Verbose {
-			log.Printf("deleting: %+v\n", m.TraceFiles[key])
+	sort.Slice(stable, func(i, j int) bool {
+		if stable[i].FirstSeen.Equal(stable[j].FirstSeen) {
+			return stable[i].Filename < stable[j].Filename
 		}
-		delete(m.TraceFiles, key)
+		return stable[i].FirstSeen.Before(stable[j].FirstSeen)
+	})
+	blocked := make(map[string]bool)
+	for _, file := range stable {
+		if blocked[file.Username] {
+			continue
+		}
+		if !pool.Enqueue(file) {
+			slog.Debug("delivery queue full", LOG_USER, file.Username, LOG_FILE, file.Filename)
+			blocked[file.Username] = true
+			continue
+		}
+		file.Queued = true
+	}
+}
+
+// finished records a delivery result from the pool
+func (m *Monitor) finished(result deliveryResult) {
+	if result.done {
+		slog.Debug("deleting", LOG_FILE, result.file.Filename)
+		delete(m.TraceFiles, result.file.Filename)
+		return
 	}
+	result.file.Queued = false
 }
 
+// scan updates the size counter and returns true when the file is stable;
+// a file removed from under the monitor, such as by the disable command,
+// is dropped
 func (t *TraceFile) scan(m *Monitor) bool {
 	stat, err := os.Stat(t.Filename)
+	if os.IsNotExist(err) {
+		slog.Warn("dropping", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, "file_removed")
+		delete(m.TraceFiles, t.Filename)
+		return false
+	}
 	if err != nil {
-		log.Fatal(err)
+		slog.Warn("failed stat", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+		return false
 	}
 	if t.Size == stat.Size() {
 		// if the file size has not changed, bump the counter
 		t.Count += 1
-		if m.Verbose {
-			log.Printf("bump: %+v\n", *t)
-		}
+		slog.Debug("bump", LOG_USER, t.Username, LOG_FILE, t.Filename, "size", t.Size, "count", t.Count)
 	} else {
 		// the file size has changed, remember the new size and reset the counter
 		t.Size = stat.Size()
 		t.Count = 0
-		if m.Verbose {
-			log.Printf("changed: %+v\n", *t)
-		}
+		slog.Debug("changed", LOG_USER, t.Username, LOG_FILE, t.Filename, "size", t.Size, "count", t.Count)
 	}
-	if t.Count >= m.StabilizeCount {
-		if m.Verbose {
-			log.Printf("stabilized: %+v\n", *t)
-		}
-		if t.shouldForward(m) {
-			err := SendFile(t.Username, m.Domain, t.Filename)
+	stable, err := t.isStable(m, stat)
+	if err != nil {
+		slog.Warn("stabilization check failed", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+		return false
+	}
+	if stable {
+		slog.Debug("stabilized", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_DURATION, time.Since(t.FirstSeen))
+	}
+	return stable
+}
+
+// process runs the parsing and delivery stages for a stable file, then
+// removes it; it returns false if the file must be kept for a later attempt
+func (t *TraceFile) process(ctx context.Context, m *Monitor) bool {
+	trace, err := ParseTrace(t.Filename)
+	if t.removed(err) {
+		t.recordHistory(m, HISTORY_SKIPPED)
+		return true
+	}
+	if err != nil {
+		Fatal("failed reading trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+	}
+	t.trace = trace
+	if t.shouldForward(m) {
+		if m.limiter != nil && !m.limiter.Allow(t.Username, time.Now()) {
+			slog.Warn("rate limited", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, "rate_limited")
+			t.reason = "rate_limited"
+			err := t.hold(m)
+			if t.removed(err) {
+				t.recordHistory(m, HISTORY_SKIPPED)
+				return true
+			}
 			if err != nil {
-				log.Fatal(err)
+				slog.Error("failed holding trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+				return false
 			}
+			t.recordHistory(m, HISTORY_HELD)
+			return true
 		}
-		if m.Verbose {
-			log.Printf("removing: %s\n", t.Filename)
+		outcome := t.deliver(ctx, m)
+		if outcome == "" {
+			return false
+		}
+		t.recordHistory(m, outcome)
+	} else {
+		t.recordHistory(m, HISTORY_SKIPPED)
+	}
+	slog.Debug("removing", LOG_USER, t.Username, LOG_FILE, t.Filename)
+	err = os.Remove(t.Filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		Fatal("remove failed", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+	}
+	return true
+}
+
+// removed returns true if err shows the trace file is gone, as when the
+// disable command removes the user's trace directory while the file is
+// queued; the file is then dropped rather than treated as a failure
+func (t *TraceFile) removed(err error) bool {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	slog.Warn("dropping", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, "tracing_disabled", "error", err)
+	t.reason = "tracing_disabled"
+	return true
+}
+
+// deliver sends the trace, recording the attempt in the delivery journal;
+// it returns the history outcome, or an empty string if the file must be
+// kept for a later attempt
+func (t *TraceFile) deliver(ctx context.Context, m *Monitor) string {
+	key := ""
+	if m.journal != nil {
+		var err error
+		key, err = FileIdentity(t.Filename)
+		if t.removed(err) {
+			return HISTORY_SKIPPED
 		}
-		err = os.Remove(t.Filename)
 		if err != nil {
-			log.Fatal(err)
+			Fatal("failed reading file identity", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+		}
+		switch m.journal.State(key) {
+		case JOURNAL_SENT:
+			slog.Info("skipping", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, "already_sent", LOG_RULE, "journal")
+			t.reason = "already_sent"
+			return HISTORY_DUPLICATE
+		case JOURNAL_SENDING:
+			slog.Warn("previous delivery attempt incomplete, resending", LOG_USER, t.Username, LOG_FILE, t.Filename)
+		}
+		err = m.journal.Record(key, JOURNAL_SENDING, t.Username, t.Filename)
+		if err != nil {
+			Fatal("failed writing journal", LOG_FILE, m.JournalFile, "error", err)
+		}
+	}
+	if t.trace == nil {
+		trace, err := ParseTrace(t.Filename)
+		if t.removed(err) {
+			t.journalFailed(m, key)
+			return HISTORY_SKIPPED
+		}
+		if err != nil {
+			Fatal("failed reading trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+		}
+		t.trace = trace
+	}
+	monitorID := NewMonitorID()
+	messageID, err := m.send(ctx, t.Username, t.trace, monitorID)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// shutdown deadline passed; leave the file for the next start
+			slog.Warn("send interrupted by shutdown", LOG_USER, t.Username, LOG_FILE, t.Filename)
+			return ""
+		}
+		if t.removed(err) {
+			t.journalFailed(m, key)
+			return HISTORY_SKIPPED
+		}
+		var encryptionError *EncryptionError
+		if errors.As(err, &encryptionError) {
+			// an unusable user key must not stop forwarding for everyone
+			slog.Error("skipping", LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, "encryption_failed", "error", err)
+			t.reason = "encryption_failed"
+			t.journalFailed(m, key)
+			return HISTORY_SKIPPED
+		}
+		var rejected *WebhookRejected
+		if errors.As(err, &rejected) {
+			// resending the same event would be rejected again
+			slog.Error("webhook rejected trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+			t.reason = "webhook_rejected"
+			t.journalFailed(m, key)
+			return HISTORY_REJECTED
+		}
+		if m.Transport == TRANSPORT_WEBHOOK {
+			// the file is kept and retried on a later pass
+			t.failures++
+			delay := m.webhook.retryDelay(t.failures)
+			t.retryAt = time.Now().Add(delay)
+			slog.Error("webhook failed, keeping trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "failures", t.failures, "retry", delay, "error", err)
+			return ""
+		}
+		Fatal("send failed", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
+	}
+	m.recent.Record(messageID)
+	if m.journal != nil {
+		err = m.journal.Record(key, JOURNAL_SENT, t.Username, t.Filename)
+		if err != nil {
+			Fatal("failed writing journal", LOG_FILE, m.JournalFile, "error", err)
 		}
-		return true
 	}
-	return false
+	return HISTORY_FORWARDED
 }
 
-func (t *TraceFile) shouldForward(m *Monitor) bool {
-
-	file, err := os.Open(t.Filename)
+// journalFailed closes the journal entry of a delivery that is given up
+func (t *TraceFile) journalFailed(m *Monitor, key string) {
+	if m.journal == nil {
+		return
+	}
+	err := m.journal.Record(key, JOURNAL_FAILED, t.Username, t.Filename)
 	if err != nil {
-		log.Fatal(err)
+		Fatal("failed writing journal", LOG_FILE, m.JournalFile, "error", err)
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	defer func() {
-		err = scanner.Err()
+}
+
+// send delivers a trace through the configured transport, returning the
+// Message-ID of the mail sent, or an empty string for a webhook
+func (m *Monitor) send(ctx context.Context, username string, trace *Trace, monitorID string) (string, error) {
+	if m.webhook != nil {
+		return "", m.webhook.Send(ctx, username, m.Domain, trace, monitorID)
+	}
+	return SendFile(ctx, username, m.Domain, trace, monitorID)
+}
+
+// sendDigest delivers a rate limit digest through the configured transport
+func (m *Monitor) sendDigest(ctx context.Context, username string, filenames []string) error {
+	if m.webhook != nil {
+		return m.webhook.SendDigest(ctx, username, m.Domain, filenames)
+	}
+	return SendDigest(ctx, username, m.Domain, filenames)
+}
+
+// sendNotice delivers a notice through the configured transport
+func (m *Monitor) sendNotice(ctx context.Context, username, subject, text string) error {
+	if m.webhook != nil {
+		return m.webhook.SendNotice(ctx, username, m.Domain, subject, text)
+	}
+	return SendNotice(ctx, username, m.Domain, subject, text)
+}
+
+func (t *TraceFile) shouldForward(m *Monitor) bool {
+
+	if t.trace == nil {
+		trace, err := ParseTrace(t.Filename)
 		if err != nil {
-			log.Fatal(err)
+			Fatal("failed reading trace", LOG_USER, t.Username, LOG_FILE, t.Filename, "error", err)
 		}
-	}()
+		t.trace = trace
+	}
+	trace := t.trace
 
 	// default to skip
 	forward := false
 	reason := "non_message_delivery_trace"
+	rule := "default"
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if TRACE_PATTERN_MESSAGE.MatchString(line) {
-			reason = "message_delivery_trace"
-			forward = true
-		}
-		if TRACE_PATTERN_DAEMON.MatchString(line) {
-			reason = "sender_is_daemon"
-			forward = false
-		}
-		if TRACE_PATTERN_EXECUTE.MatchString(line) {
-			break
-		}
+	switch {
+	case len(trace.MonitorIDs) > 0:
+		reason = "loop_detected"
+		rule = "monitor_id"
+	case m.recent.HasMessage(trace.MessageID):
+		reason = "loop_detected"
+		rule = "message_id"
+	case trace.FromDaemon:
+		reason = "sender_is_daemon"
+		rule = "daemon"
+	case trace.Delivery:
+		reason = "message_delivery_trace"
+		rule = "message"
+		forward = true
 	}
-	action := "Forwarding"
+	t.reason = reason
+	action := "forwarding"
 	if !forward {
-		action = "Skipping"
+		action = "skipping"
 	}
-	log.Printf("%s %s: %s\n", action, reason, t.Filename)
+	slog.Info(action, LOG_USER, t.Username, LOG_FILE, t.Filename, LOG_REASON, reason, LOG_RULE, rule, "session", trace.SessionID)
 	return forward
 }
 
 func (m *Monitor) scanDirs() {
 	for user, home := range m.UserHomes {
-		dir := filepath.Join(home, "sieve_trace")
+		dir := filepath.Join(home, TRACE_DIR)
 		if IsDir(dir) {
-			if m.Verbose {
-				log.Printf("scanning: %s\n", dir)
-			}
+			m.trackTraceDir(user, dir)
+			slog.Debug("scanning", LOG_USER, user, "dir", dir)
 			pattern := filepath.Join(dir, "*.trace")
 			files, err := filepath.Glob(pattern)
 			if err != nil {
-				log.Fatalf("failed scanning %s: %v", pattern, err)
+				Fatal("failed scanning", LOG_USER, user, "pattern", pattern, "error", err)
 			}
 			for _, filename := range files {
 				_, found := m.TraceFiles[filename]
 				if !found {
 					stat, err := os.Stat(filename)
 					if err != nil {
-						log.Fatal(err)
+						Fatal("failed stat", LOG_USER, user, LOG_FILE, filename, "error", err)
 					}
 					// record the new file for stabilization check
 					file := TraceFile{
-						Username: user,
-						Filename: filename,
-						Size:     stat.Size(),
-						Count:    0,
+						Username:  user,
+						Filename:  filename,
+						Size:      stat.Size(),
+						Count:     0,
+						FirstSeen: time.Now(),
 					}
 					m.TraceFiles[filename] = &file
-					if m.Verbose {
-						log.Printf("added: %+v\n", file)
-					}
+					slog.Debug("added", LOG_USER, user, LOG_FILE, filename, "size", file.Size)
 				}
 
 			}
@@ -273,20 +551,163 @@ func (m *Monitor) scanDirs() {
 	}
 }
 
-func (m *Monitor) Run() error {
-	log.Printf("monitoring sieve_trace directories")
+// Reload re-reads the config file and rebuilds the monitored user set
+func (m *Monitor) Reload() {
+	err := viper.ReadInConfig()
+	if err != nil {
+		slog.Warn("reload: failed reading config", "error", err)
+	}
+	m.MinUID = viper.GetInt("min_uid")
+	m.SkipUsers = strings.Split(viper.GetString("skip_users"), ",")
+	m.UserHomes = make(map[string]string)
+	m.initUserHomes()
+	slog.Info("reloaded", "users", len(m.UserHomes))
+}
+
+// Run processes trace files until ctx is cancelled, then waits up to
+// ShutdownTimeout for in-flight deliveries and checkpoints pending files
+func (m *Monitor) Run(ctx context.Context) error {
+	slog.Info("monitoring sieve_trace directories")
 	scanSeconds := viper.GetInt64("scan_interval_seconds")
 	scanTicker := time.NewTicker(time.Duration(scanSeconds) * time.Second)
+	defer scanTicker.Stop()
 	stabilizeSeconds := viper.GetInt64("stabilize_interval_seconds")
 	stabilizeTicker := time.NewTicker(time.Duration(stabilizeSeconds) * time.Second)
+	defer stabilizeTicker.Stop()
+
+	err := m.LoadState()
+	if err != nil {
+		slog.Error("failed restoring state", LOG_FILE, m.StateFile, "error", err)
+	}
+	var save <-chan time.Time
+	if m.StateFile != "" && m.StateSave > 0 {
+		saveTicker := time.NewTicker(m.StateSave)
+		defer saveTicker.Stop()
+		save = saveTicker.C
+	}
+
+	if m.JournalFile != "" {
+		journal, err := OpenJournal(m.JournalFile)
+		if err != nil {
+			return fmt.Errorf("failed opening journal: %v", err)
+		}
+		m.journal = journal
+		defer func() {
+			m.journal.Close()
+			m.journal = nil
+		}()
+	}
+	var prune <-chan time.Time
+	if m.HistoryFile != "" {
+		m.history = NewHistory(m.HistoryFile)
+		defer func() { m.history = nil }()
+		if m.HistoryRetention > 0 {
+			pruneTicker := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+			defer pruneTicker.Stop()
+			prune = pruneTicker.C
+		}
+	}
+	err = m.startWeb(ctx)
+	if err != nil {
+		return fmt.Errorf("failed starting web UI: %v", err)
+	}
+	var digest <-chan time.Time
+	if m.limiter != nil && m.DigestInterval > 0 {
+		digestTicker := time.NewTicker(m.DigestInterval)
+		defer digestTicker.Stop()
+		digest = digestTicker.C
+	}
+	var compact <-chan time.Time
+	if m.journal != nil && m.JournalCompact > 0 {
+		compactTicker := time.NewTicker(m.JournalCompact)
+		defer compactTicker.Stop()
+		compact = compactTicker.C
+	}
+
+	var expire <-chan time.Time
+	if m.TracingFile != "" && m.TracingCheck > 0 {
+		expireTicker := time.NewTicker(m.TracingCheck)
+		defer expireTicker.Stop()
+		expire = expireTicker.C
+	}
+
+	// deliveries are cancelled only once the shutdown deadline has passed
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	go func() {
+		select {
+		case <-ctx.Done():
+			timer := time.NewTimer(m.ShutdownTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				slog.Warn("shutdown timeout expired, cancelling deliveries")
+				cancelSend()
+			case <-sendCtx.Done():
+			}
+		case <-sendCtx.Done():
+		}
+	}()
+	pool := NewDeliveryPool(ctx, sendCtx, m, m.DeliveryWorkers, m.DeliveryQueueSize)
+
+	// a nil channel never fires, leaving the watchdog disabled
+	var watchdog <-chan time.Time
+	if m.Watchdog > 0 {
+		watchdogTicker := time.NewTicker(m.Watchdog)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+	sdNotify(fmt.Sprintf("READY=1\nSTATUS=monitoring %d users", len(m.UserHomes)))
 	for {
 		select {
 		case <-scanTicker.C:
 			m.scanDirs()
 		case <-stabilizeTicker.C:
-			m.scanFiles()
-		case <-m.stop:
-			log.Printf("exiting")
+			m.scanFiles(ctx, pool)
+		case result := <-pool.Results():
+			m.finished(result)
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+		case <-save:
+			err := m.SaveState()
+			if err != nil {
+				slog.Error("failed saving state", LOG_FILE, m.StateFile, "error", err)
+			}
+		case <-digest:
+			m.startDigests(sendCtx)
+		case now := <-expire:
+			m.expireTracing(sendCtx, now)
+		case <-compact:
+			removed, err := m.journal.Compact(m.JournalRetention)
+			if err != nil {
+				slog.Error("journal compaction failed", LOG_FILE, m.JournalFile, "error", err)
+			} else {
+				slog.Debug("journal compacted", LOG_FILE, m.JournalFile, "removed", removed)
+			}
+		case now := <-prune:
+			removed, err := m.history.Prune(now.Add(-m.HistoryRetention))
+			if err != nil {
+				slog.Error("history pruning failed", LOG_FILE, m.HistoryFile, "error", err)
+			} else {
+				slog.Debug("history pruned", LOG_FILE, m.HistoryFile, "removed", removed)
+			}
+		case <-m.reload:
+			sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+			m.Reload()
+			sdNotify(fmt.Sprintf("READY=1\nSTATUS=monitoring %d users", len(m.UserHomes)))
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			// stop accepting work and collect the in-flight results
+			pool.Close()
+			for result := range pool.Results() {
+				m.finished(result)
+			}
+			m.background.Wait()
+			err := m.SaveState()
+			if err != nil {
+				slog.Error("failed saving state", LOG_FILE, m.StateFile, "error", err)
+			}
+			slog.Info("exiting", "pending", len(m.TraceFiles))
 			return nil
 		}
 	}
@@ -1,10 +1,17 @@
 package cmd
 
 import (
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"os"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	viper.SetDefault("domain", "example.org")
+	os.Exit(m.Run())
+}
+
 func TestTraceFileImapSieve(t *testing.T) {
 	m := NewMonitor()
 	m.Verbose = true
@@ -28,3 +35,26 @@ func TestTraceFileDelivery(t *testing.T) {
 	forward := file.shouldForward(m)
 	require.True(t, forward)
 }
+
+func TestTraceFileLoopMonitorID(t *testing.T) {
+	m := NewMonitor()
+	file := TraceFile{Filename: "testdata/loop.trace"}
+	forward := file.shouldForward(m)
+	require.False(t, forward)
+}
+
+func TestTraceFileLoopMessageID(t *testing.T) {
+	m := NewMonitor()
+	file := TraceFile{Filename: "testdata/thread.trace"}
+	require.True(t, file.shouldForward(m))
+
+	// a trace of the message we sent is a loop
+	m.recent.Record("CAF3x9k2@mail.example.com")
+	file = TraceFile{Filename: "testdata/thread.trace"}
+	require.False(t, file.shouldForward(m))
+	require.Equal(t, "loop_detected", file.reason)
+
+	// traces of other messages are still forwarded
+	file = TraceFile{Filename: "testdata/delivery.trace"}
+	require.True(t, file.shouldForward(m))
+}
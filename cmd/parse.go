@@ -0,0 +1,135 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var parseCmd = &cobra.Command{
+	Use:   "parse FILE...",
+	Short: "parse trace files",
+	Long: `
+Run each trace file through the trace parser and write the result to
+stdout as JSON (default) or YAML, or as a short text summary with
+--summary.  Useful for checking sieve scripts against saved traces.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		traces := []*Trace{}
+		for _, filename := range args {
+			trace, err := ParseTrace(filename)
+			cobra.CheckErr(err)
+			traces = append(traces, trace)
+		}
+		if viper.GetBool("parse.summary") {
+			for _, trace := range traces {
+				writeTraceSummary(os.Stdout, trace)
+			}
+			return
+		}
+		var v any = traces
+		if len(traces) == 1 {
+			v = traces[0]
+		}
+		output, err := formatTraces(viper.GetString("parse.format"), v)
+		cobra.CheckErr(err)
+		fmt.Print(output)
+	},
+}
+
+// formatTraces renders parsed traces as json or yaml
+func formatTraces(format string, v any) (string, error) {
+	switch format {
+	case "json", "":
+		return FormatJSON(v) + "\n", nil
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("unknown format: %s", format)
+}
+
+// writeTraceSummary writes the identifying fields of a trace followed by
+// the steps of each script and the resulting actions
+func writeTraceSummary(w io.Writer, trace *Trace) {
+	fmt.Fprintf(w, "file: %s\n", trace.Filename)
+	fmt.Fprintf(w, "kind: %s\n", trace.Kind)
+	for _, field := range [][2]string{
+		{"username", trace.Username},
+		{"session", trace.SessionID},
+		{"sender", trace.Sender},
+		{"message-id", trace.MessageID},
+		{"subject", trace.Subject},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(w, "%s: %s\n", field[0], field[1])
+		}
+	}
+	if len(trace.MonitorIDs) > 0 {
+		fmt.Fprintf(w, "monitor-ids: %s\n", strings.Join(trace.MonitorIDs, ", "))
+	}
+	for _, script := range trace.Scripts {
+		fmt.Fprintf(w, "script %s:\n", script.Name)
+		for _, step := range script.Steps {
+			if step.Result != "" {
+				fmt.Fprintf(w, "  %4d: %s => %s\n", step.Line, step.Command, step.Result)
+			} else {
+				fmt.Fprintf(w, "  %4d: %s\n", step.Line, step.Command)
+			}
+		}
+	}
+	if len(trace.Actions) > 0 {
+		fmt.Fprintf(w, "actions:\n")
+		for _, action := range trace.Actions {
+			fmt.Fprintf(w, "  %s\n", action)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func init() {
+	rootCmd.AddCommand(parseCmd)
+	parseCmd.Flags().String("format", "json", "output format (json, yaml)")
+	viper.BindPFlag("parse.format", parseCmd.Flags().Lookup("format"))
+	parseCmd.Flags().Bool("summary", false, "output a text summary")
+	viper.BindPFlag("parse.summary", parseCmd.Flags().Lookup("summary"))
+}
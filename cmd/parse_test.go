@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+func TestFormatTracesYAML(t *testing.T) {
+	trace, err := ParseTrace("testdata/actions.trace")
+	require.Nil(t, err)
+	output, err := formatTraces("yaml", trace)
+	require.Nil(t, err)
+	var parsed Trace
+	err = yaml.Unmarshal([]byte(output), &parsed)
+	require.Nil(t, err)
+	require.Equal(t, trace.SessionID, parsed.SessionID)
+	require.Equal(t, trace.Actions, parsed.Actions)
+	_, err = formatTraces("xml", trace)
+	require.NotNil(t, err)
+}
+
+func TestTraceSummary(t *testing.T) {
+	trace, err := ParseTrace("testdata/actions.trace")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	writeTraceSummary(&buf, trace)
+	require.Contains(t, buf.String(), "session: Zk3aQ1pEP2hwVQEA8o/S4w\n")
+	require.Contains(t, buf.String(), "script new-mail:\n")
+	require.Contains(t, buf.String(), "     6: header test => matched\n")
+	require.Contains(t, buf.String(), "actions:\n  store message in mailbox `Lists'\n")
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+type deliveryResult struct {
+	file *TraceFile
+	done bool
+}
+
+// DeliveryPool runs the parsing and delivery stages on a fixed set of
+// workers; each user is pinned to one worker so their traces stay in order.
+// When a delivery fails, the user's later files are returned unprocessed
+// until the failed file is queued again and succeeds.
+type DeliveryPool struct {
+	queues  []chan *TraceFile
+	results chan deliveryResult
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	blocked map[string]string
+}
+
+// NewDeliveryPool starts the workers; jobs dequeued after ctx is cancelled
+// are returned unprocessed, and sendCtx bounds deliveries in progress
+func NewDeliveryPool(ctx, sendCtx context.Context, m *Monitor, workers, queueSize int) *DeliveryPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	p := DeliveryPool{
+		queues:  make([]chan *TraceFile, workers),
+		results: make(chan deliveryResult, workers*queueSize),
+		blocked: make(map[string]string),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *TraceFile, queueSize)
+		p.wg.Add(1)
+		go p.worker(ctx, sendCtx, m, p.queues[i])
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.results)
+	}()
+	return &p
+}
+
+func (p *DeliveryPool) worker(ctx, sendCtx context.Context, m *Monitor, queue chan *TraceFile) {
+	defer p.wg.Done()
+	for file := range queue {
+		if ctx.Err() != nil || !p.ready(file) {
+			p.results <- deliveryResult{file: file, done: false}
+			continue
+		}
+		done := file.process(sendCtx, m)
+		if !done && ctx.Err() == nil {
+			p.block(file)
+		}
+		p.results <- deliveryResult{file: file, done: done}
+	}
+}
+
+// ready returns false when an older file of the same user has failed; the
+// failed file itself clears the block so it can be retried
+func (p *DeliveryPool) ready(file *TraceFile) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	failed, found := p.blocked[file.Username]
+	if !found {
+		return true
+	}
+	if failed != file.Filename {
+		return false
+	}
+	delete(p.blocked, file.Username)
+	return true
+}
+
+func (p *DeliveryPool) block(file *TraceFile) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.blocked[file.Username] = file.Filename
+}
+
+// Unblock releases the user's files held behind file, for use when the
+// failed file is dropped rather than retried
+func (p *DeliveryPool) Unblock(file *TraceFile) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.blocked[file.Username] == file.Filename {
+		delete(p.blocked, file.Username)
+	}
+}
+
+// Enqueue queues file on its user's worker, returning false if the queue is full
+func (p *DeliveryPool) Enqueue(file *TraceFile) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(file.Username))
+	queue := p.queues[hash.Sum32()%uint32(len(p.queues))]
+	select {
+	case queue <- file:
+		return true
+	default:
+		return false
+	}
+}
+
+// Results returns the channel of completed jobs; it is closed once Close
+// has been called and the workers have drained their queues
+func (p *DeliveryPool) Results() <-chan deliveryResult {
+	return p.results
+}
+
+func (p *DeliveryPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+}
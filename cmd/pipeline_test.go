@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliveryPool(t *testing.T) {
+	data, err := os.ReadFile("testdata/imapsieve.trace")
+	require.Nil(t, err)
+	dir := t.TempDir()
+	m := Monitor{TraceFiles: make(map[string]*TraceFile)}
+	for _, name := range []string{"a1", "a2", "b1"} {
+		filename := filepath.Join(dir, name+".trace")
+		require.Nil(t, os.WriteFile(filename, data, 0600))
+		m.TraceFiles[filename] = &TraceFile{Username: name[:1], Filename: filename}
+	}
+
+	ctx := context.Background()
+	pool := NewDeliveryPool(ctx, ctx, &m, 2, 4)
+	for _, file := range m.TraceFiles {
+		require.True(t, pool.Enqueue(file))
+		file.Queued = true
+	}
+	pool.Close()
+	for result := range pool.Results() {
+		require.True(t, result.done)
+		m.finished(result)
+	}
+	require.Empty(t, m.TraceFiles)
+	files, err := filepath.Glob(filepath.Join(dir, "*.trace"))
+	require.Nil(t, err)
+	require.Empty(t, files)
+}
+
+func TestDeliveryPoolCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := Monitor{TraceFiles: make(map[string]*TraceFile)}
+	file := TraceFile{Username: "a", Filename: "testdata/delivery.trace", Queued: true}
+	m.TraceFiles[file.Filename] = &file
+
+	pool := NewDeliveryPool(ctx, ctx, &m, 1, 1)
+	require.True(t, pool.Enqueue(&file))
+	pool.Close()
+	for result := range pool.Results() {
+		require.False(t, result.done)
+		m.finished(result)
+	}
+	require.False(t, file.Queued)
+	require.Len(t, m.TraceFiles, 1)
+	require.True(t, IsFile("testdata/delivery.trace"))
+}
+
+func TestDeliveryPoolFailureKeepsOrder(t *testing.T) {
+	data, err := os.ReadFile("testdata/delivery.trace")
+	require.Nil(t, err)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	m := Monitor{
+		TraceFiles: make(map[string]*TraceFile),
+		Transport:  TRANSPORT_WEBHOOK,
+		Domain:     "example.org",
+		webhook:    newTestWebhook(server.URL),
+	}
+	files := []*TraceFile{}
+	for _, name := range []string{"a1", "a2"} {
+		filename := filepath.Join(dir, name+".trace")
+		require.Nil(t, os.WriteFile(filename, data, 0600))
+		file := TraceFile{Username: "a", Filename: filename}
+		m.TraceFiles[filename] = &file
+		files = append(files, &file)
+	}
+
+	ctx := context.Background()
+	pool := NewDeliveryPool(ctx, ctx, &m, 1, 4)
+	for _, file := range files {
+		require.True(t, pool.Enqueue(file))
+	}
+	for range files {
+		result := <-pool.Results()
+		require.False(t, result.done)
+		m.finished(result)
+	}
+	// the newer file was held back without being sent
+	require.Equal(t, int32(1), requests.Load())
+	require.Len(t, m.TraceFiles, 2)
+	// the failed file waits out its retry delay
+	require.True(t, files[0].retryAt.After(time.Now()))
+	require.Equal(t, 1, files[0].failures)
+
+	for _, file := range files {
+		require.True(t, pool.Enqueue(file))
+	}
+	pool.Close()
+	for result := range pool.Results() {
+		require.True(t, result.done)
+		m.finished(result)
+	}
+	require.Equal(t, int32(3), requests.Load())
+	require.Empty(t, m.TraceFiles)
+}
+
+func TestScanFilesRemoved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Monitor{TraceFiles: make(map[string]*TraceFile)}
+	file := TraceFile{Username: "a", Filename: filepath.Join(t.TempDir(), "a1.trace")}
+	m.TraceFiles[file.Filename] = &file
+
+	pool := NewDeliveryPool(ctx, ctx, &m, 1, 1)
+	defer pool.Close()
+	pool.block(&file)
+	m.scanFiles(ctx, pool)
+	require.Empty(t, m.TraceFiles)
+	require.True(t, pool.ready(&TraceFile{Username: "a", Filename: "a2.trace"}))
+}
+
+func TestDeliveryPoolFileRemoved(t *testing.T) {
+	ctx := context.Background()
+	m := Monitor{TraceFiles: make(map[string]*TraceFile)}
+	file := TraceFile{Username: "a", Filename: filepath.Join(t.TempDir(), "a1.trace"), Queued: true}
+	m.TraceFiles[file.Filename] = &file
+
+	// the file was removed by disable after it was queued
+	pool := NewDeliveryPool(ctx, ctx, &m, 1, 1)
+	require.True(t, pool.Enqueue(&file))
+	pool.Close()
+	for result := range pool.Results() {
+		require.True(t, result.done)
+		m.finished(result)
+	}
+	require.Empty(t, m.TraceFiles)
+	require.Equal(t, "tracing_disabled", file.reason)
+}
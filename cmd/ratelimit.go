@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_RATE_LIMIT_USER_PER_HOUR = 0
+const DEFAULT_RATE_LIMIT_USER_BURST = 20
+const DEFAULT_RATE_LIMIT_GLOBAL_PER_HOUR = 0
+const DEFAULT_RATE_LIMIT_GLOBAL_BURST = 100
+const DEFAULT_DIGEST_DIR = "/var/lib/sieve-monitor/digest"
+const DEFAULT_DIGEST_INTERVAL_MINUTES = 60
+
+// DIGEST_MAX_TRACES caps the traces attached to one digest; the rest are
+// only listed by name
+const DIGEST_MAX_TRACES = 20
+
+// HOLD_MAX_NAMES caps the numbered names tried for a held trace
+const HOLD_MAX_NAMES = 1000
+
+// TokenBucket refills at Rate tokens per second up to Burst tokens
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(perHour, burst int, now time.Time) *TokenBucket {
+	return &TokenBucket{
+		Rate:   float64(perHour) / 3600,
+		Burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if now.Before(b.last) {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+	b.last = now
+}
+
+// RateLimiter applies a per-user and a global token bucket; a nil bucket
+// rate means that limit is disabled
+type RateLimiter struct {
+	UserPerHour int
+	UserBurst   int
+	global      *TokenBucket
+	users       map[string]*TokenBucket
+	mutex       sync.Mutex
+}
+
+func NewRateLimiter(userPerHour, userBurst, globalPerHour, globalBurst int) *RateLimiter {
+	l := RateLimiter{
+		UserPerHour: userPerHour,
+		UserBurst:   userBurst,
+		users:       make(map[string]*TokenBucket),
+	}
+	if globalPerHour > 0 {
+		l.global = NewTokenBucket(globalPerHour, globalBurst, time.Now())
+	}
+	return &l
+}
+
+// Allow consumes a token from both buckets if both have one available
+func (l *RateLimiter) Allow(username string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var user *TokenBucket
+	if l.UserPerHour > 0 {
+		user = l.users[username]
+		if user == nil {
+			user = NewTokenBucket(l.UserPerHour, l.UserBurst, now)
+			l.users[username] = user
+		}
+		user.refill(now)
+		if user.tokens < 1 {
+			return false
+		}
+	}
+	if l.global != nil {
+		l.global.refill(now)
+		if l.global.tokens < 1 {
+			return false
+		}
+		l.global.tokens -= 1
+	}
+	if user != nil {
+		user.tokens -= 1
+	}
+	return true
+}
+
+// hold moves a rate limited trace into the user's digest directory
+func (t *TraceFile) hold(m *Monitor) error {
+	dir := filepath.Join(m.DigestDir, t.Username)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	_, basename := filepath.Split(t.Filename)
+	_, err = moveFile(t.Filename, dir, basename)
+	return err
+}
+
+// startDigests flushes the digests in the background, so a slow sendmail
+// or webhook does not hold up scanning; a flush still running is left to
+// finish
+func (m *Monitor) startDigests(ctx context.Context) {
+	if !m.digesting.CompareAndSwap(false, true) {
+		slog.Debug("digest flush still running")
+		return
+	}
+	m.background.Go(func() {
+		defer m.digesting.Store(false)
+		m.flushDigests(ctx)
+	})
+}
+
+// flushDigests sends each user's held traces as one digest message
+func (m *Monitor) flushDigests(ctx context.Context) {
+	dirs, err := os.ReadDir(m.DigestDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed reading digest dir", "dir", m.DigestDir, "error", err)
+		}
+		return
+	}
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return
+		}
+		if !dir.IsDir() {
+			continue
+		}
+		username := dir.Name()
+		filenames, err := filepath.Glob(filepath.Join(m.DigestDir, username, "*.trace"))
+		if err != nil || len(filenames) == 0 {
+			continue
+		}
+		sort.Strings(filenames)
+		err = m.sendDigest(ctx, username, filenames)
+		var encryptionError *EncryptionError
+		var rejected *WebhookRejected
+		if errors.As(err, &encryptionError) {
+			// retrying cannot succeed until the user fixes their key
+			slog.Error("discarding digest", LOG_USER, username, "count", len(filenames), LOG_REASON, "encryption_failed", "error", err)
+		} else if errors.As(err, &rejected) {
+			slog.Error("discarding digest", LOG_USER, username, "count", len(filenames), LOG_REASON, "webhook_rejected", "error", err)
+		} else if err != nil {
+			slog.Error("digest send failed", LOG_USER, username, "count", len(filenames), "error", err)
+			continue
+		}
+		for _, filename := range filenames {
+			err := os.Remove(filename)
+			if err != nil {
+				slog.Error("remove failed", LOG_USER, username, LOG_FILE, filename, "error", err)
+			}
+		}
+	}
+}
+
+// moveFile moves src into dir as basename, numbering the name when it is
+// taken so a held trace is never overwritten; across devices the copy is
+// written under a temporary name first, so a flush never sees a partial
+// file. It returns the destination.
+func moveFile(src, dir, basename string) (string, error) {
+	dst, err := renameUnique(src, dir, basename)
+	if !errors.Is(err, syscall.EXDEV) {
+		return dst, err
+	}
+	tmp, err := copyTemp(src, dir)
+	if err != nil {
+		return "", err
+	}
+	dst, err = renameUnique(tmp, dir, basename)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dst, os.Remove(src)
+}
+
+// renameUnique renames src into dir without replacing an existing file,
+// trying basename and then basename with a counter before its extension
+func renameUnique(src, dir, basename string) (string, error) {
+	ext := filepath.Ext(basename)
+	stem := strings.TrimSuffix(basename, ext)
+	for i := 0; i < HOLD_MAX_NAMES; i++ {
+		name := basename
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+		}
+		dst := filepath.Join(dir, name)
+		err := unix.Renameat2(unix.AT_FDCWD, src, unix.AT_FDCWD, dst, unix.RENAME_NOREPLACE)
+		if errors.Is(err, syscall.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return "", &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+		}
+		return dst, nil
+	}
+	return "", fmt.Errorf("no free name for %s in %s", basename, dir)
+}
+
+// copyTemp copies src to a new temporary file in dir, named so the digest
+// glob does not match it
+func copyTemp(src, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(dir, ".hold-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
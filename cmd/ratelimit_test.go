@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUser(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(60, 2, 0, 0)
+	require.True(t, limiter.Allow("alice", now))
+	require.True(t, limiter.Allow("alice", now))
+	require.False(t, limiter.Allow("alice", now))
+	// other users have their own bucket
+	require.True(t, limiter.Allow("bob", now))
+	// one token per minute at 60 per hour
+	require.True(t, limiter.Allow("alice", now.Add(time.Minute)))
+	require.False(t, limiter.Allow("alice", now.Add(time.Minute)))
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	limiter := NewRateLimiter(0, 0, 3600, 1)
+	now := time.Now()
+	require.True(t, limiter.Allow("alice", now))
+	require.False(t, limiter.Allow("bob", now))
+	require.True(t, limiter.Allow("bob", now.Add(time.Second)))
+}
+
+func TestFormatDigest(t *testing.T) {
+	var buf bytes.Buffer
+	filenames := []string{"testdata/delivery.trace", "testdata/daemon.trace"}
+	_, err := formatDigest("alice", "example.org", filenames, &buf)
+	require.Nil(t, err)
+	message := buf.String()
+	require.Contains(t, message, "Subject: Sieve Trace: rate limited, 2 traces suppressed")
+	require.Contains(t, message, "Session ID: 0BnLMUyJPmgzqAAA8o/S4w")
+	require.Contains(t, message, "Session ID: cP4pErgcP2hwVQEA8o/S4w")
+}
+
+func TestFormatDigestLimit(t *testing.T) {
+	data, err := os.ReadFile("testdata/delivery.trace")
+	require.Nil(t, err)
+	dir := t.TempDir()
+	filenames := []string{}
+	for i := 0; i < DIGEST_MAX_TRACES+5; i++ {
+		filename := filepath.Join(dir, fmt.Sprintf("%03d.trace", i))
+		require.Nil(t, os.WriteFile(filename, data, 0600))
+		filenames = append(filenames, filename)
+	}
+	var buf bytes.Buffer
+	_, err = formatDigest("alice", "example.org", filenames, &buf)
+	require.Nil(t, err)
+	message := buf.String()
+	require.Contains(t, message, fmt.Sprintf("%d traces suppressed", len(filenames)))
+	require.Contains(t, message, "and 5 more")
+	require.Equal(t, DIGEST_MAX_TRACES, strings.Count(message, "Session ID: cP4pErgcP2hwVQEA8o/S4w"))
+}
+
+func TestMoveFileUnique(t *testing.T) {
+	src := t.TempDir()
+	dir := t.TempDir()
+	for i, content := range []string{"first", "second"} {
+		filename := filepath.Join(src, "a.trace")
+		require.Nil(t, os.WriteFile(filename, []byte(content), 0600))
+		dst, err := moveFile(filename, dir, "a.trace")
+		require.Nil(t, err)
+		require.False(t, IsFile(filename))
+		if i == 0 {
+			require.Equal(t, filepath.Join(dir, "a.trace"), dst)
+		} else {
+			require.Equal(t, filepath.Join(dir, "a.1.trace"), dst)
+		}
+	}
+	// the first held file was not overwritten
+	data, err := os.ReadFile(filepath.Join(dir, "a.trace"))
+	require.Nil(t, err)
+	require.Equal(t, "first", string(data))
+}
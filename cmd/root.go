@@ -31,6 +31,7 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -51,14 +52,32 @@ Scans for a directory named 'sieve_trace' in each user's home directory.
 For each file found matching the pattern '~/sieve_trace/*.trace', the 
 contents are sent to the user as a message from "SIEVE_DAEMON".
 After sending, deletes the trace file.
+
+Every setting may also be given as an environment variable named
+SIEVE_MONITOR_ followed by the setting in upper case, with dots in nested
+settings replaced by underscores (dkim.key_file is SIEVE_MONITOR_DKIM_KEY_FILE).
+Appending _FILE to the variable name reads the value from that file.
+'config init' lists every variable.
 `,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		OpenLog()
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if signalFlag != "" {
+			SendSignal()
+			return
+		}
 		DaemonizeDisabled = viper.GetBool("foreground")
 		monitor := NewMonitor()
-		Daemonize(func() {
-			err := monitor.Run()
+		if viper.GetBool("systemd") {
+			err := RunSystemd(monitor)
 			cobra.CheckErr(err)
-		}, "/var/log/sieve-monitor", &monitor.stop)
+			return
+		}
+		Daemonize(func(ctx context.Context) {
+			err := monitor.Run(ctx)
+			cobra.CheckErr(err)
+		}, DaemonLogFile(), &monitor.reload)
 	},
 }
 
@@ -70,13 +89,21 @@ func Execute() {
 }
 func init() {
 	cobra.OnInitialize(initConfig)
-	OptionString("logfile", "l", "stderr", "log filename")
+	OptionString("logfile", "l", "stderr", "log target (stderr, stdout, syslog, journald, or a filename)")
+	OptionString("log-level", "", DEFAULT_LOG_LEVEL, "log level (debug, info, warn, error)")
+	OptionString("log-format", "", DEFAULT_LOG_FORMAT, "log format (text, json)")
 	OptionSwitch("debug", "", "produce debug output")
 	OptionSwitch("verbose", "v", "increase verbosity")
 	OptionSwitch("foreground", "", "do not daemonize")
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "/etc/sieve-monitor/config.yaml", "config file (default is /etc/sieve-monitor/config.yaml)")
+	OptionSwitch("systemd", "", "run in the foreground as a systemd notify service")
+	OptionString("pidfile", "", DEFAULT_PIDFILE, "daemon pid file")
+	rootCmd.PersistentFlags().StringVarP(&signalFlag, "signal", "s", "", "send signal to running daemon (stop, reload, reopen)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "/etc/sieve-monitor/config.yaml", "config file (default is /etc/sieve-monitor/config.yaml, or SIEVE_MONITOR_CONFIG)")
 }
 func initConfig() {
+	if filename, found := os.LookupEnv(envPrefix() + "_CONFIG"); found && !rootCmd.PersistentFlags().Changed("config") {
+		cfgFile = filename
+	}
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 	} else {
@@ -86,11 +113,11 @@ func initConfig() {
 		viper.SetConfigType("yaml")
 		viper.SetConfigName(".sieve-monitor")
 	}
-	viper.SetEnvPrefix(rootCmd.Name())
+	err := bindEnv()
+	cobra.CheckErr(err)
 	if err := viper.ReadInConfig(); err == nil {
 		if viper.GetBool("verbose") {
 			fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 		}
 	}
-	OpenLog()
 }
@@ -0,0 +1,128 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var sendCmd = &cobra.Command{
+	Use:   "send --user USER [--to ADDR] FILE",
+	Short: "send a trace file",
+	Long: `
+Format FILE as a trace message for USER and send it through the
+configured transport the same way the daemon does, without the daemon
+running.  The trace file is left in place.  --to mails another address
+instead of the user, and --print writes the message, or the webhook
+payload, to stdout instead of sending it.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := viper.GetString("send.user")
+		if username == "" {
+			cobra.CheckErr(fmt.Errorf("--user is required"))
+		}
+		err := sendTrace(os.Stdout, username, viper.GetString("send.to"), args[0], viper.GetBool("send.print"))
+		cobra.CheckErr(err)
+	},
+}
+
+// sendTrace sends filename as a trace message for username, or writes it to
+// w when print is set; only the domain, DKIM signer and transport are
+// loaded, since a monitor would read passwd and log a daemon startup
+func sendTrace(w io.Writer, username, to, filename string, print bool) error {
+	setConfigDefaults()
+	domain, err := configDomain()
+	if err != nil {
+		return err
+	}
+	Signer, err = LoadDKIMSigner()
+	if err != nil {
+		return err
+	}
+	trace, err := ParseTrace(filename)
+	if err != nil {
+		return err
+	}
+	monitorID := NewMonitorID()
+	switch transport := viper.GetString("transport"); transport {
+	case TRANSPORT_SENDMAIL:
+	case TRANSPORT_WEBHOOK:
+		if to != "" {
+			return fmt.Errorf("--to does not apply to the webhook transport")
+		}
+		webhook, err := NewWebhook()
+		if err != nil {
+			return err
+		}
+		if print {
+			payload, err := webhook.Payload(username, domain, trace, monitorID)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(w, FormatJSON(payload))
+			return err
+		}
+		return webhook.Send(context.Background(), username, domain, trace, monitorID)
+	default:
+		return fmt.Errorf("unknown transport: %s", transport)
+	}
+	if print {
+		message, _, _, err := NewTraceMessage(username, domain, to, trace, monitorID)
+		if err != nil {
+			return err
+		}
+		message, err = signMessage(domain, message)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, message)
+		return err
+	}
+	_, err = SendFileTo(context.Background(), username, domain, to, trace, monitorID)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(sendCmd)
+	sendCmd.Flags().String("user", "", "user the trace belongs to")
+	viper.BindPFlag("send.user", sendCmd.Flags().Lookup("user"))
+	sendCmd.Flags().String("to", "", "recipient address (default is the user)")
+	viper.BindPFlag("send.to", sendCmd.Flags().Lookup("to"))
+	sendCmd.Flags().Bool("print", false, "write the message to stdout instead of sending")
+	viper.BindPFlag("send.print", sendCmd.Flags().Lookup("print"))
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/mail"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func setSendConfig(t *testing.T, values map[string]any) {
+	for key, value := range values {
+		previous := viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, previous) })
+	}
+}
+
+func TestSendPrint(t *testing.T) {
+	setSendConfig(t, map[string]any{
+		"domain":     "example.org",
+		"transport":  TRANSPORT_SENDMAIL,
+		"encryption": "off",
+	})
+	var buf bytes.Buffer
+	require.Nil(t, sendTrace(&buf, "alice", "", "testdata/thread.trace", true))
+	reader, err := mail.CreateReader(&buf)
+	require.Nil(t, err)
+	subject, err := reader.Header.Subject()
+	require.Nil(t, err)
+	require.Equal(t, "Sieve Trace: Quarterly report draft", subject)
+	to, err := reader.Header.AddressList("To")
+	require.Nil(t, err)
+	require.Equal(t, "alice@example.org", to[0].Address)
+	require.Equal(t, "alice", reader.Header.Get("X-Sieve-Trace-Username"))
+	require.NotEmpty(t, reader.Header.Get("X-Sieve-Monitor-Id"))
+	require.NotEmpty(t, reader.Header.Get("Message-Id"))
+
+	buf.Reset()
+	require.Nil(t, sendTrace(&buf, "alice", "postmaster@example.org", "testdata/thread.trace", true))
+	reader, err = mail.CreateReader(&buf)
+	require.Nil(t, err)
+	to, err = reader.Header.AddressList("To")
+	require.Nil(t, err)
+	require.Equal(t, "postmaster@example.org", to[0].Address)
+}
+
+func TestSendPrintEncrypted(t *testing.T) {
+	account, err := user.Current()
+	require.Nil(t, err)
+	home, _ := userAccount(account.Username)
+	entity, err := openpgp.NewEntity("alice", "", "alice@example.org", nil)
+	require.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "pubkey.asc")
+	file, err := os.Create(keyFile)
+	require.Nil(t, err)
+	writer, err := armor.Encode(file, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(writer))
+	require.Nil(t, writer.Close())
+	require.Nil(t, file.Close())
+	// the key path is relative to the user's home directory
+	relative, err := filepath.Rel(home, keyFile)
+	require.Nil(t, err)
+
+	setSendConfig(t, map[string]any{
+		"domain":                "example.org",
+		"transport":             TRANSPORT_SENDMAIL,
+		"encryption":            "auto",
+		"encryption_pgp_key":    relative,
+		"encryption_smime_cert": "",
+	})
+	var buf bytes.Buffer
+	require.Nil(t, sendTrace(&buf, account.Username, "", "testdata/thread.trace", true))
+	require.NotContains(t, buf.String(), "Quarterly report draft")
+	reader, err := mail.CreateReader(&buf)
+	require.Nil(t, err)
+	subject, err := reader.Header.Subject()
+	require.Nil(t, err)
+	require.Equal(t, ENCRYPTED_SUBJECT, subject)
+	require.Contains(t, reader.Header.Get("Content-Type"), "multipart/encrypted")
+}
+
+func TestSendPrintWebhook(t *testing.T) {
+	setSendConfig(t, map[string]any{
+		"domain":      "example.org",
+		"transport":   TRANSPORT_WEBHOOK,
+		"webhook_url": "http://127.0.0.1:1/hook",
+	})
+	var buf bytes.Buffer
+	require.NotNil(t, sendTrace(&buf, "alice", "bob@example.org", "testdata/thread.trace", true))
+	require.Nil(t, sendTrace(&buf, "alice", "", "testdata/thread.trace", true))
+	var payload WebhookPayload
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &payload))
+	require.Equal(t, "trace", payload.Event)
+	require.Equal(t, "alice@example.org", payload.Address)
+	require.Equal(t, "Quarterly report draft", payload.Subject)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_STABILIZE_STRATEGY = "size"
+const DEFAULT_STABILIZE_MTIME_MS = 1000
+
+// PROC_LOCKS lists the file locks held on Linux
+const PROC_LOCKS = "/proc/locks"
+
+// the combined strategy waits for a quiet, closed and unlocked file
+var STABILIZE_COMBINED = []string{"mtime", "open", "lock"}
+
+type stabilizeCheck func(t *TraceFile, m *Monitor, stat os.FileInfo) (bool, error)
+
+var STABILIZE_CHECKS = map[string]stabilizeCheck{
+	"size":  stableSize,
+	"mtime": stableMtime,
+	"open":  stableNotOpen,
+	"lock":  stableNotLocked,
+}
+
+// parseStabilizeStrategy returns the checks named by a comma separated
+// strategy list, expanding "combined"
+func parseStabilizeStrategy(strategy string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(strategy, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "combined":
+			names = append(names, STABILIZE_COMBINED...)
+		case STABILIZE_CHECKS[name] != nil:
+			names = append(names, name)
+		default:
+			return nil, fmt.Errorf("unknown stabilize strategy: %s", name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, DEFAULT_STABILIZE_STRATEGY)
+	}
+	for _, name := range names {
+		if name == "open" && !IsDir("/proc/self/fd") {
+			return nil, fmt.Errorf("stabilize strategy 'open' requires /proc")
+		}
+	}
+	return names, nil
+}
+
+// isStable returns true when every configured check passes
+func (t *TraceFile) isStable(m *Monitor, stat os.FileInfo) (bool, error) {
+	for _, name := range m.StabilizeStrategy {
+		stable, err := STABILIZE_CHECKS[name](t, m, stat)
+		if err != nil || !stable {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func stableSize(t *TraceFile, m *Monitor, stat os.FileInfo) (bool, error) {
+	return t.Count >= m.StabilizeCount, nil
+}
+
+func stableMtime(t *TraceFile, m *Monitor, stat os.FileInfo) (bool, error) {
+	return time.Since(stat.ModTime()) >= m.StabilizeMtime, nil
+}
+
+func stableNotOpen(t *TraceFile, m *Monitor, stat os.FileInfo) (bool, error) {
+	open, err := isOpenByProcess(t.Filename)
+	return !open, err
+}
+
+func stableNotLocked(t *TraceFile, m *Monitor, stat os.FileInfo) (bool, error) {
+	locked, err := isLocked(t.Filename)
+	return !locked, err
+}
+
+// isOpenByProcess scans /proc/*/fd for a descriptor referring to filename;
+// a process that cannot be inspected is an error, since the file may be
+// open there
+func isOpenByProcess(filename string) (bool, error) {
+	target, err := filepath.Abs(filename)
+	if err != nil {
+		return false, err
+	}
+	procs, err := filepath.Glob("/proc/[0-9]*/fd")
+	if err != nil {
+		return false, err
+	}
+	for _, proc := range procs {
+		fds, err := os.ReadDir(proc)
+		if err != nil {
+			// processes exit while scanning
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, unix.ESRCH) {
+				continue
+			}
+			return false, err
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(proc, fd.Name()))
+			if err != nil {
+				// descriptors close while scanning
+				if errors.Is(err, fs.ErrNotExist) || errors.Is(err, unix.ESRCH) {
+					continue
+				}
+				return false, err
+			}
+			if link == target {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isLocked probes for a conflicting fcntl lock held by another process,
+// then checks /proc/locks for a flock(2) lock, which F_GETLK does not
+// report on Linux; without /proc only fcntl locks are seen
+func isLocked(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	lock := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: 0,
+		Start:  0,
+		Len:    0,
+	}
+	err = unix.FcntlFlock(file.Fd(), unix.F_GETLK, &lock)
+	if err != nil {
+		return false, err
+	}
+	if lock.Type != unix.F_UNLCK {
+		return true, nil
+	}
+	var stat unix.Stat_t
+	err = unix.Fstat(int(file.Fd()), &stat)
+	if err != nil {
+		return false, err
+	}
+	return isFlocked(PROC_LOCKS, &stat)
+}
+
+// isFlocked returns true if the locks file lists a held flock(2) lock on
+// the file; its lines read "1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF",
+// with waiting requests marked by "->" after the number
+func isFlocked(locksFile string, stat *unix.Stat_t) (bool, error) {
+	data, err := os.ReadFile(locksFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	dev := uint64(stat.Dev)
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(dev), unix.Minor(dev), stat.Ino)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 6 && fields[1] == "FLOCK" && fields[5] == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
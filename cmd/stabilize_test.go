@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStabilizeStrategy(t *testing.T) {
+	names, err := parseStabilizeStrategy("")
+	require.Nil(t, err)
+	require.Equal(t, []string{"size"}, names)
+
+	names, err = parseStabilizeStrategy("size, mtime")
+	require.Nil(t, err)
+	require.Equal(t, []string{"size", "mtime"}, names)
+
+	_, err = parseStabilizeStrategy("inotify")
+	require.NotNil(t, err)
+}
+
+func TestStabilizeMtime(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.trace")
+	require.Nil(t, os.WriteFile(filename, []byte("trace"), 0600))
+	m := Monitor{StabilizeStrategy: []string{"mtime"}, StabilizeMtime: time.Minute}
+	file := TraceFile{Filename: filename}
+
+	stat, err := os.Stat(filename)
+	require.Nil(t, err)
+	stable, err := file.isStable(&m, stat)
+	require.Nil(t, err)
+	require.False(t, stable)
+
+	old := time.Now().Add(-2 * time.Minute)
+	require.Nil(t, os.Chtimes(filename, old, old))
+	stat, err = os.Stat(filename)
+	require.Nil(t, err)
+	stable, err = file.isStable(&m, stat)
+	require.Nil(t, err)
+	require.True(t, stable)
+}
+
+func TestStabilizeOpen(t *testing.T) {
+	if !IsDir("/proc/self/fd") {
+		t.Skip("requires /proc")
+	}
+	filename := filepath.Join(t.TempDir(), "test.trace")
+	writer, err := os.Create(filename)
+	require.Nil(t, err)
+	open, err := isOpenByProcess(filename)
+	if errors.Is(err, fs.ErrPermission) {
+		writer.Close()
+		t.Skip("requires access to every process's descriptors")
+	}
+	require.Nil(t, err)
+	require.True(t, open)
+
+	require.Nil(t, writer.Close())
+	open, err = isOpenByProcess(filename)
+	require.Nil(t, err)
+	require.False(t, open)
+}
+
+func TestStabilizeLock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.trace")
+	require.Nil(t, os.WriteFile(filename, []byte("trace"), 0600))
+	m := Monitor{StabilizeStrategy: []string{"lock"}}
+	file := TraceFile{Filename: filename}
+	stat, err := os.Stat(filename)
+	require.Nil(t, err)
+
+	stable, err := file.isStable(&m, stat)
+	require.Nil(t, err)
+	require.True(t, stable)
+
+	// an open file description lock conflicts with the probe like a lock
+	// held by another process
+	writer, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	require.Nil(t, err)
+	lock := unix.Flock_t{Type: unix.F_WRLCK}
+	require.Nil(t, unix.FcntlFlock(writer.Fd(), unix.F_OFD_SETLK, &lock))
+	stable, err = file.isStable(&m, stat)
+	require.Nil(t, err)
+	require.False(t, stable)
+	require.Nil(t, writer.Close())
+
+	stable, err = file.isStable(&m, stat)
+	require.Nil(t, err)
+	require.True(t, stable)
+}
+
+func TestIsFlocked(t *testing.T) {
+	stat := unix.Stat_t{Dev: unix.Mkdev(8, 1), Ino: 5678}
+	locks := filepath.Join(t.TempDir(), "locks")
+	write := func(lines ...string) {
+		data := ""
+		for _, line := range lines {
+			data += line + "\n"
+		}
+		require.Nil(t, os.WriteFile(locks, []byte(data), 0600))
+	}
+
+	write("1: POSIX  ADVISORY  WRITE 1234 08:01:5678 0 EOF")
+	locked, err := isFlocked(locks, &stat)
+	require.Nil(t, err)
+	require.False(t, locked)
+
+	write("1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF", "1: -> FLOCK  ADVISORY  WRITE 4321 08:01:5678 0 EOF")
+	locked, err = isFlocked(locks, &stat)
+	require.Nil(t, err)
+	require.True(t, locked)
+
+	write("1: -> FLOCK  ADVISORY  WRITE 4321 08:01:5678 0 EOF", fmt.Sprintf("2: FLOCK  ADVISORY  WRITE 1234 08:01:%d 0 EOF", stat.Ino+1))
+	locked, err = isFlocked(locks, &stat)
+	require.Nil(t, err)
+	require.False(t, locked)
+
+	locked, err = isFlocked(filepath.Join(t.TempDir(), "missing"), &stat)
+	require.Nil(t, err)
+	require.False(t, locked)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SaveState writes the pending TraceFiles to StateFile, replacing it atomically
+func (m *Monitor) SaveState() error {
+	if m.StateFile == "" {
+		return nil
+	}
+	files := []*TraceFile{}
+	for _, file := range m.TraceFiles {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(m.StateFile), 0700)
+	if err != nil {
+		return err
+	}
+	tmpFile := m.StateFile + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, m.StateFile)
+}
+
+// LoadState restores TraceFiles saved by SaveState, dropping entries whose
+// file no longer exists or whose user is no longer monitored
+func (m *Monitor) LoadState() error {
+	if m.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	files := []*TraceFile{}
+	err = json.Unmarshal(data, &files)
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for _, file := range files {
+		_, monitored := m.UserHomes[file.Username]
+		if !monitored || !IsFile(file.Filename) {
+			slog.Debug("dropping saved state", LOG_USER, file.Username, LOG_FILE, file.Filename)
+			continue
+		}
+		_, found := m.TraceFiles[file.Filename]
+		if found {
+			continue
+		}
+		m.TraceFiles[file.Filename] = file
+		restored++
+	}
+	slog.Info("restored state", LOG_FILE, m.StateFile, "pending", restored)
+	return nil
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept.trace")
+	gone := filepath.Join(dir, "gone.trace")
+	require.Nil(t, os.WriteFile(kept, []byte("trace"), 0600))
+	require.Nil(t, os.WriteFile(gone, []byte("trace"), 0600))
+
+	firstSeen := time.Now().Add(-time.Minute).Round(time.Second)
+	m := Monitor{
+		StateFile: filepath.Join(dir, "state", "state.json"),
+		UserHomes: map[string]string{"alice": dir},
+		TraceFiles: map[string]*TraceFile{
+			kept: {Username: "alice", Filename: kept, Size: 5, Count: 3, FirstSeen: firstSeen},
+			gone: {Username: "alice", Filename: gone, Size: 5, Count: 1, FirstSeen: firstSeen},
+		},
+	}
+	require.Nil(t, m.SaveState())
+	require.Nil(t, os.Remove(gone))
+
+	restored := Monitor{
+		StateFile:  m.StateFile,
+		UserHomes:  m.UserHomes,
+		TraceFiles: make(map[string]*TraceFile),
+	}
+	require.Nil(t, restored.LoadState())
+	require.Len(t, restored.TraceFiles, 1)
+	file := restored.TraceFiles[kept]
+	require.NotNil(t, file)
+	require.Equal(t, 3, file.Count)
+	require.True(t, firstSeen.Equal(file.FirstSeen))
+}
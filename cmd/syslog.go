@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+var SYSLOG_FACILITIES = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogHandler formats records as text and writes them to the local
+// syslog socket at the severity matching the record level
+type syslogHandler struct {
+	writer  *syslog.Writer
+	handler slog.Handler
+	buf     *bytes.Buffer
+	mutex   *sync.Mutex
+}
+
+func newSyslogHandler(tag, facility string, options *slog.HandlerOptions) (*syslogHandler, error) {
+	if facility == "" {
+		facility = DEFAULT_SYSLOG_FACILITY
+	}
+	priority, ok := SYSLOG_FACILITIES[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility: %s", facility)
+	}
+	writer, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	textOptions := *options
+	textOptions.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		// syslog supplies its own timestamp
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		if options.ReplaceAttr != nil {
+			return options.ReplaceAttr(groups, a)
+		}
+		return a
+	}
+	h := syslogHandler{
+		writer:  writer,
+		handler: slog.NewTextHandler(&buf, &textOptions),
+		buf:     &buf,
+		mutex:   &sync.Mutex{},
+	}
+	return &h, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.buf.Reset()
+	err := h.handler.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(h.buf.String())
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.writer.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.writer.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.writer.Info(line)
+	}
+	return h.writer.Debug(line)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.handler = h.handler.WithAttrs(attrs)
+	return &c
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.handler = h.handler.WithGroup(name)
+	return &c
+}
+
+func (h *syslogHandler) Close() error {
+	return h.writer.Close()
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SdNotify sends a state string to the systemd notify socket; it is a no-op
+// when not running under a systemd Type=notify service
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify failed: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("sd_notify failed: %v", err)
+	}
+	return nil
+}
+
+func sdNotify(state string) {
+	err := SdNotify(state)
+	if err != nil {
+		slog.Warn("systemd notify failed", "state", state, "error", err)
+	}
+}
+
+// monotonicUsec returns CLOCK_MONOTONIC in microseconds, as systemd
+// expects alongside RELOADING=1
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
+
+// WatchdogInterval returns the interval at which WATCHDOG=1 should be sent,
+// half the timeout systemd passes in WATCHDOG_USEC, or 0 if disabled
+func WatchdogInterval() time.Duration {
+	value := os.Getenv("WATCHDOG_USEC")
+	if value == "" {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || usec <= 0 {
+		slog.Warn("invalid WATCHDOG_USEC", "value", value)
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// RunSystemd runs the monitor in the foreground, translating signals into
+// monitor stop and reload requests
+func RunSystemd(monitor *Monitor) error {
+	var err error
+	runWithSignals("systemd", func(ctx context.Context) {
+		err = monitor.Run(ctx)
+	}, monitor.reload, func() {
+		sdNotify("STOPPING=1")
+	})
+	return err
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.socket")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.Nil(t, err)
+	defer listener.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	err = SdNotify("READY=1")
+	require.Nil(t, err)
+
+	buf := make([]byte, 256)
+	n, err := listener.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestSdNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.Nil(t, SdNotify("READY=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	require.Equal(t, 15*time.Second, WatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(1))
+	require.Equal(t, time.Duration(0), WatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "")
+	require.Equal(t, time.Duration(0), WatchdogInterval())
+}
+
+func TestRequestReloadNonBlocking(t *testing.T) {
+	ch := make(chan struct{}, 1)
+	requestReload(ch)
+	// a second request while one is pending must not block
+	requestReload(ch)
+	require.Len(t, ch, 1)
+	requestReload(make(chan struct{}))
+}
+
+func TestUnitTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	config := UnitConfig{Executable: "/usr/local/bin/sieve-monitor", Config: "/etc/sieve-monitor/config.yaml", Watchdog: 60}
+	require.Nil(t, UNIT_TEMPLATE.Execute(&buf, &config))
+	unit := buf.String()
+	require.Contains(t, unit, "Type=notify\n")
+	require.Contains(t, unit, "ExecStart=/usr/local/bin/sieve-monitor --systemd --config /etc/sieve-monitor/config.yaml\n")
+	require.Contains(t, unit, "ExecReload=/bin/kill -HUP $MAINPID\n")
+	require.Contains(t, unit, "\nWatchdogSec=60\nRestart=on-failure\n")
+
+	buf.Reset()
+	config.Watchdog = 0
+	require.Nil(t, UNIT_TEMPLATE.Execute(&buf, &config))
+	unit = buf.String()
+	require.NotContains(t, unit, "WatchdogSec")
+	require.Contains(t, unit, "ExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\n")
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var TRACE_PATTERN_KIND = regexp.MustCompile(`trace log for (.+):\s*$`)
+var TRACE_PATTERN_FIELD = regexp.MustCompile(`^\s+([A-Za-z][A-Za-z -]*):\s*(.*)$`)
+var TRACE_PATTERN_EXTRACT = regexp.MustCompile("extracting `([^']+)' headers? from message")
+var TRACE_PATTERN_VALUE = regexp.MustCompile("matching value `(.*)'\\s*$")
+var TRACE_PATTERN_MONITOR_ID = regexp.MustCompile(MONITOR_ID_PREFIX + `[0-9a-f]{32}`)
+var TRACE_PATTERN_SCRIPT = regexp.MustCompile(`## Started executing script '([^']*)'`)
+var TRACE_PATTERN_STEP = regexp.MustCompile(`^\s*(\d+): (\S.*)$`)
+var TRACE_PATTERN_DETAIL = regexp.MustCompile(`^\s*(\d+):\s+(\S.*)$`)
+var TRACE_PATTERN_RESULT = regexp.MustCompile(`finishing match with result: (.+)$`)
+
+const TRACE_KIND_DELIVERY = "message_delivery"
+
+// Trace is the parsed form of a Pigeonhole sieve trace file
+type Trace struct {
+	Filename   string            `json:"file" yaml:"file"`
+	Kind       string            `json:"kind" yaml:"kind"`
+	Username   string            `json:"username,omitempty" yaml:"username,omitempty"`
+	SessionID  string            `json:"session_id,omitempty" yaml:"session_id,omitempty"`
+	Sender     string            `json:"sender,omitempty" yaml:"sender,omitempty"`
+	MessageID  string            `json:"message_id,omitempty" yaml:"message_id,omitempty"`
+	Subject    string            `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Fields     map[string]string `json:"fields" yaml:"fields"`
+	Delivery   bool              `json:"delivery" yaml:"delivery"`
+	FromDaemon bool              `json:"from_daemon" yaml:"from_daemon"`
+	MonitorIDs []string          `json:"monitor_ids,omitempty" yaml:"monitor_ids,omitempty"`
+	Scripts    []*TraceScript    `json:"scripts,omitempty" yaml:"scripts,omitempty"`
+	Actions    []string          `json:"actions,omitempty" yaml:"actions,omitempty"`
+}
+
+// TraceScript is one script execution within a trace, in the order the
+// scripts were started; included scripts appear as separate entries
+type TraceScript struct {
+	Name  string       `json:"name" yaml:"name"`
+	Steps []*TraceStep `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
+// TraceStep is one executed command or test with its indented detail lines
+type TraceStep struct {
+	Line    int      `json:"line" yaml:"line"`
+	Command string   `json:"command" yaml:"command"`
+	Details []string `json:"details,omitempty" yaml:"details,omitempty"`
+	Result  string   `json:"result,omitempty" yaml:"result,omitempty"`
+}
+
+// ParseTrace reads the header fields that precede script execution and
+// scans the whole trace for monitor ids stamped on our own mail
+func ParseTrace(filename string) (*Trace, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var script *TraceScript
+	var step *TraceStep
+	trace := Trace{
+		Filename: filename,
+		Kind:     "unknown",
+		Fields:   make(map[string]string),
+	}
+	header := true
+	// header values seen in header tests, keyed by lowercase header name
+	values := make(map[string]string)
+	extracting := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, id := range TRACE_PATTERN_MONITOR_ID.FindAllString(line, -1) {
+			trace.MonitorIDs = append(trace.MonitorIDs, id)
+		}
+		if !header {
+			match := TRACE_PATTERN_SCRIPT.FindStringSubmatch(line)
+			if match != nil {
+				script = &TraceScript{Name: match[1]}
+				trace.Scripts = append(trace.Scripts, script)
+				step = nil
+				continue
+			}
+			step = trace.addStep(script, step, line)
+			match = TRACE_PATTERN_EXTRACT.FindStringSubmatch(line)
+			if match != nil {
+				extracting = strings.ToLower(match[1])
+				continue
+			}
+			match = TRACE_PATTERN_VALUE.FindStringSubmatch(line)
+			if match != nil && extracting != "" {
+				_, found := values[extracting]
+				if !found {
+					values[extracting] = match[1]
+				}
+				// only the first value follows the extraction line
+				extracting = ""
+			}
+			continue
+		}
+		if TRACE_PATTERN_EXECUTE.MatchString(line) {
+			header = false
+			match := TRACE_PATTERN_SCRIPT.FindStringSubmatch(line)
+			if match != nil {
+				script = &TraceScript{Name: match[1]}
+				trace.Scripts = append(trace.Scripts, script)
+			}
+			continue
+		}
+		if TRACE_PATTERN_MESSAGE.MatchString(line) {
+			trace.Delivery = true
+		}
+		if TRACE_PATTERN_DAEMON.MatchString(line) {
+			trace.FromDaemon = true
+		}
+		match := TRACE_PATTERN_KIND.FindStringSubmatch(line)
+		if match != nil {
+			trace.Kind = traceKind(match[1])
+			continue
+		}
+		match = TRACE_PATTERN_FIELD.FindStringSubmatch(line)
+		if match != nil {
+			trace.Fields[match[1]] = strings.TrimSpace(match[2])
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	trace.Username = trace.Fields["Username"]
+	trace.SessionID = trace.Fields["Session ID"]
+	trace.Sender = strings.Trim(trace.Fields["Sender"], "<>")
+	trace.MessageID = firstValue(trace.Fields["Message-ID"], trace.Fields["Message ID"], values["message-id"])
+	trace.MessageID = strings.Trim(trace.MessageID, "<>")
+	trace.Subject = firstValue(trace.Fields["Subject"], values["subject"])
+	return &trace, nil
+}
+
+// addStep adds a numbered trace line to the running script, returning the
+// step that subsequent detail lines belong to
+func (t *Trace) addStep(script *TraceScript, step *TraceStep, line string) *TraceStep {
+	if script == nil {
+		return step
+	}
+	match := TRACE_PATTERN_STEP.FindStringSubmatch(line)
+	if match != nil {
+		number, _ := strconv.Atoi(match[1])
+		step = &TraceStep{Line: number, Command: strings.TrimSpace(match[2])}
+		script.Steps = append(script.Steps, step)
+		if strings.HasSuffix(step.Command, " action") {
+			t.Actions = append(t.Actions, step.Command)
+		}
+		return step
+	}
+	match = TRACE_PATTERN_DETAIL.FindStringSubmatch(line)
+	if match == nil || step == nil {
+		return step
+	}
+	detail := strings.TrimSpace(match[2])
+	step.Details = append(step.Details, detail)
+	result := TRACE_PATTERN_RESULT.FindStringSubmatch(detail)
+	if result != nil {
+		step.Result = result[1]
+	}
+	if strings.HasSuffix(step.Command, " action") && len(step.Details) == 1 {
+		// the first detail of an action describes what it will do
+		t.Actions[len(t.Actions)-1] = detail
+	}
+	return step
+}
+
+func firstValue(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func traceKind(name string) string {
+	kind := strings.ToLower(strings.TrimSpace(name))
+	return strings.ReplaceAll(kind, " ", "_")
+}
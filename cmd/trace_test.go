@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseTraceDelivery(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	require.Equal(t, TRACE_KIND_DELIVERY, trace.Kind)
+	require.Equal(t, "mkrueger", trace.Username)
+	require.Equal(t, "cP4pErgcP2hwVQEA8o/S4w", trace.SessionID)
+	require.Equal(t, "email_feedback_handler@bbcsreturn.convio.net", trace.Sender)
+	require.Equal(t, "INBOX", trace.Fields["Default mailbox"])
+	require.True(t, trace.Delivery)
+	require.False(t, trace.FromDaemon)
+	require.Empty(t, trace.MonitorIDs)
+}
+
+func TestParseTraceImapSieve(t *testing.T) {
+	trace, err := ParseTrace("testdata/imapsieve.trace")
+	require.Nil(t, err)
+	require.Equal(t, "imapsieve", trace.Kind)
+	require.Equal(t, "FLAG", trace.Fields["Cause"])
+	require.False(t, trace.Delivery)
+}
+
+func TestParseTraceLoop(t *testing.T) {
+	trace, err := ParseTrace("testdata/loop.trace")
+	require.Nil(t, err)
+	require.Equal(t, []string{"smid-5f0c2a9e4b7d41c3a8e6f1d2b3c4a5e6"}, trace.MonitorIDs)
+}
+
+func TestParseTraceThread(t *testing.T) {
+	trace, err := ParseTrace("testdata/thread.trace")
+	require.Nil(t, err)
+	require.Equal(t, "Quarterly report draft", trace.Subject)
+	require.Equal(t, "CAF3x9k2@mail.example.com", trace.MessageID)
+}
+
+func TestParseTraceScripts(t *testing.T) {
+	trace, err := ParseTrace("testdata/actions.trace")
+	require.Nil(t, err)
+	require.Len(t, trace.Scripts, 1)
+	script := trace.Scripts[0]
+	require.Equal(t, "new-mail", script.Name)
+	require.Len(t, script.Steps, 4)
+	require.Equal(t, 6, script.Steps[0].Line)
+	require.Equal(t, "header test", script.Steps[0].Command)
+	require.Equal(t, "matched", script.Steps[0].Result)
+	require.Equal(t, "fileinto action", script.Steps[2].Command)
+	require.Equal(t, []string{"store message in mailbox `Lists'"}, trace.Actions)
+}
+
+func TestParseTraceIncludes(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	require.Len(t, trace.Scripts, 2)
+	require.Equal(t, "new-mail", trace.Scripts[0].Name)
+	require.Equal(t, "ignore-daemons", trace.Scripts[1].Name)
+	require.Empty(t, trace.Actions)
+}
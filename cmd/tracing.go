@@ -0,0 +1,435 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_TRACING_FILE = "/var/lib/sieve-monitor/tracing.json"
+const DEFAULT_TRACING_CHECK_SECONDS = 60
+const DEFAULT_TRACE_LEVEL = "matching"
+const DEFAULT_TRACE_HOURS = 24
+const DEFAULT_TRACING_MAX_HOURS = 0
+
+// tracing record sources
+const TRACING_ENABLE = "enable"
+const TRACING_SCAN = "scan"
+
+// TRACE_LEVELS are the Pigeonhole sieve_trace_level values, least verbose first
+var TRACE_LEVELS = []string{"actions", "commands", "tests", "matching"}
+
+// Tracing records a user's trace directory and when it expires.  Records
+// from the enable command carry their own expiry, with zero never
+// expiring; directories the monitor finds expire maxAge after they appeared.
+type Tracing struct {
+	Username string    `json:"username"`
+	Dir      string    `json:"dir"`
+	Source   string    `json:"source"`
+	Level    string    `json:"level,omitempty"`
+	Enabled  time.Time `json:"enabled"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+func (t *Tracing) expired(now time.Time, maxAge time.Duration) bool {
+	if t.Source == TRACING_SCAN {
+		return maxAge > 0 && now.Sub(t.Enabled) >= maxAge
+	}
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// updateTracing applies update to the tracing records in filename under an
+// exclusive lock, so the daemon and the enable and disable commands do not
+// lose each other's changes
+func updateTracing(filename string, update func(map[string]*Tracing) error) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	records, err := LoadTracing(filename)
+	if err != nil {
+		return err
+	}
+	err = update(records)
+	if err != nil {
+		return err
+	}
+	list := []*Tracing{}
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, filename)
+	if err != nil {
+		return err
+	}
+	levelFile := viper.GetString("tracing_level_file")
+	if levelFile == "" {
+		return nil
+	}
+	return writeTraceLevels(levelFile, list)
+}
+
+// writeTraceLevels writes the trace levels of enabled users as a Dovecot
+// passwd-file userdb, so each user's sieve_trace_level follows the enable
+// command
+func writeTraceLevels(filename string, records []*Tracing) error {
+	var data strings.Builder
+	for _, record := range records {
+		if record.Level != "" {
+			fmt.Fprintf(&data, "%s:::::::sieve_trace_level=%s\n", record.Username, record.Level)
+		}
+	}
+	tmpFile := filename + ".tmp"
+	err := os.WriteFile(tmpFile, []byte(data.String()), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// LoadTracing returns the tracing records keyed by username
+func LoadTracing(filename string) (map[string]*Tracing, error) {
+	records := make(map[string]*Tracing)
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []*Tracing{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range list {
+		records[record.Username] = record
+	}
+	return records, nil
+}
+
+// EnableTracing creates the user's trace directory owned by the user and
+// records the trace level and when tracing expires
+func EnableTracing(filename, username, level string, duration time.Duration) (*Tracing, error) {
+	if !slices.Contains(TRACE_LEVELS, level) {
+		return nil, fmt.Errorf("unknown trace level: %s", level)
+	}
+	account, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	record := Tracing{
+		Username: username,
+		Dir:      filepath.Join(account.HomeDir, TRACE_DIR),
+		Source:   TRACING_ENABLE,
+		Level:    level,
+		Enabled:  now,
+	}
+	if duration > 0 {
+		record.Expires = now.Add(duration)
+	}
+	err = makeTraceDir(account.HomeDir, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	err = updateTracing(filename, func(records map[string]*Tracing) error {
+		records[username] = &record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// makeTraceDir creates the trace directory in home owned by uid and gid.
+// The home directory belongs to the user, so the directory is created and
+// chowned relative to an open home descriptor without following symlinks,
+// and anything already there that is not a directory is refused.
+func makeTraceDir(home string, uid, gid int) error {
+	fd, err := unix.Open(home, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %v", home, err)
+	}
+	defer unix.Close(fd)
+	dir := filepath.Join(home, TRACE_DIR)
+	err = unix.Mkdirat(fd, TRACE_DIR, 0700)
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed creating %s: %v", dir, err)
+	}
+	var stat unix.Stat_t
+	err = unix.Fstatat(fd, TRACE_DIR, &stat, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("failed checking %s: %v", dir, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("refusing to use %s: not a directory", dir)
+	}
+	err = unix.Fchownat(fd, TRACE_DIR, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("failed changing owner of %s: %v", dir, err)
+	}
+	return nil
+}
+
+// DisableTracing removes the user's trace directory and tracing record
+func DisableTracing(filename, username string) error {
+	return updateTracing(filename, func(records map[string]*Tracing) error {
+		record, found := records[username]
+		if !found {
+			return fmt.Errorf("tracing is not enabled for %s", username)
+		}
+		err := os.RemoveAll(record.Dir)
+		if err != nil {
+			return err
+		}
+		delete(records, username)
+		return nil
+	})
+}
+
+// trackTraceDir records when a user's trace directory was first seen, so
+// directories created without the enable command also expire
+func (m *Monitor) trackTraceDir(username, dir string) {
+	if m.TracingFile == "" || m.traceDirs[username] {
+		return
+	}
+	err := updateTracing(m.TracingFile, func(records map[string]*Tracing) error {
+		_, found := records[username]
+		if !found {
+			records[username] = &Tracing{Username: username, Dir: dir, Source: TRACING_SCAN, Enabled: time.Now()}
+			slog.Info("tracing started", LOG_USER, username, "dir", dir)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed updating tracing", LOG_FILE, m.TracingFile, "error", err)
+		return
+	}
+	m.traceDirs[username] = true
+}
+
+// expireTracing disables tracing for users whose time is up; a user with
+// trace files still pending is left until they are sent.  Directories
+// from the enable command are removed; directories the user created are
+// renamed, keeping their contents, and the user is sent a notice in the
+// background.
+func (m *Monitor) expireTracing(ctx context.Context, now time.Time) {
+	pending := make(map[string]bool)
+	for _, file := range m.TraceFiles {
+		pending[file.Username] = true
+	}
+	notices := []*Tracing{}
+	renamed := make(map[string]string)
+	err := updateTracing(m.TracingFile, func(records map[string]*Tracing) error {
+		for username, record := range records {
+			if !IsDir(record.Dir) {
+				// removed by the user or the disable command
+				delete(records, username)
+				delete(m.traceDirs, username)
+				continue
+			}
+			if !record.expired(now, m.TracingMaxAge) || pending[username] {
+				continue
+			}
+			var err error
+			if record.Source == TRACING_SCAN {
+				renamed[username] = fmt.Sprintf("%s.expired-%s", record.Dir, now.Format("20060102-150405"))
+				err = os.Rename(record.Dir, renamed[username])
+			} else {
+				err = os.RemoveAll(record.Dir)
+			}
+			if err != nil {
+				slog.Error("failed disabling tracing", LOG_USER, username, "dir", record.Dir, "error", err)
+				continue
+			}
+			delete(records, username)
+			delete(m.traceDirs, username)
+			slog.Info("tracing expired", LOG_USER, username, "dir", record.Dir, "enabled", record.Enabled, "renamed", renamed[username])
+			if record.Source == TRACING_SCAN {
+				notices = append(notices, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed updating tracing", LOG_FILE, m.TracingFile, "error", err)
+	}
+	if len(notices) == 0 {
+		return
+	}
+	// notices are sent in the background so the main loop keeps scanning
+	m.background.Go(func() {
+		for _, record := range notices {
+			err := m.sendNotice(ctx, record.Username, "Sieve Trace: tracing disabled", tracingNotice(record, renamed[record.Username], m.TracingMaxAge))
+			if err != nil {
+				slog.Error("failed sending tracing notice", LOG_USER, record.Username, "error", err)
+			}
+		}
+	})
+}
+
+// tracingNotice returns the text telling a user their tracing was disabled
+func tracingNotice(record *Tracing, renamed string, maxAge time.Duration) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Sieve tracing for %s has been disabled.\n\n", record.Username)
+	fmt.Fprintf(&text, "The trace directory %s appeared at %s and has\n", record.Dir, record.Enabled.Format(time.RFC1123Z))
+	fmt.Fprintf(&text, "reached the maximum tracing lifetime of %s.\n\n", maxAge)
+	fmt.Fprintf(&text, "It was renamed to %s so no more traces are written.\n", renamed)
+	fmt.Fprintf(&text, "Create %s again to resume tracing.\n", record.Dir)
+	return text.String()
+}
+
+// doveconf returns a Dovecot setting, or an empty string when doveconf is
+// not available
+func doveconf(name string) string {
+	output, err := exec.Command("doveconf", "-h", name).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+var enableCmd = &cobra.Command{
+	Use:   "enable USER",
+	Short: "enable sieve tracing for a user",
+	Long: `
+Create the user's sieve_trace directory, owned by the user, and record
+when tracing expires.  The daemon removes the directory at expiry, which
+stops Pigeonhole writing traces.  --until 0 never expires.
+
+Dovecot must have sieve_trace_dir = ~/sieve_trace, and sieve_trace_level
+set to the level, for traces to be written.  When tracing_level_file is
+set, the levels of enabled users are written there as a passwd-file userdb
+for Dovecot to read, ahead of the main userdb, for example:
+
+  userdb {
+    driver = passwd-file
+    args = /var/lib/sieve-monitor/trace-levels
+    result_success = continue-ok
+    result_failure = continue
+    result_internalfail = continue
+  }
+
+Otherwise the setting to add to the user's userdb entry is printed.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setConfigDefaults()
+		duration, err := time.ParseDuration(viper.GetString("enable.until"))
+		cobra.CheckErr(err)
+		record, err := EnableTracing(viper.GetString("tracing_file"), args[0], viper.GetString("enable.level"), duration)
+		cobra.CheckErr(err)
+		expires := "never"
+		if !record.Expires.IsZero() {
+			expires = record.Expires.Format(time.RFC3339)
+		}
+		fmt.Printf("tracing enabled for %s in %s at level %s, expires %s\n", record.Username, record.Dir, record.Level, expires)
+		if viper.GetString("tracing_level_file") == "" {
+			fmt.Printf("set userdb field sieve_trace_level=%s for %s\n", record.Level, record.Username)
+		}
+		if dir := doveconf("plugin/sieve_trace_dir"); dir == "" {
+			fmt.Fprintln(os.Stderr, "warning: dovecot sieve_trace_dir is not set")
+		}
+	},
+}
+
+var disableCmd = &cobra.Command{
+	Use:   "disable USER",
+	Short: "disable sieve tracing for a user",
+	Long: `
+Remove the user's sieve_trace directory, including any unsent traces,
+and the tracing record.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setConfigDefaults()
+		err := DisableTracing(viper.GetString("tracing_file"), args[0])
+		cobra.CheckErr(err)
+		fmt.Printf("tracing disabled for %s\n", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(enableCmd)
+	rootCmd.AddCommand(disableCmd)
+	enableCmd.Flags().String("level", DEFAULT_TRACE_LEVEL, "trace level ("+strings.Join(TRACE_LEVELS, ", ")+")")
+	viper.BindPFlag("enable.level", enableCmd.Flags().Lookup("level"))
+	enableCmd.Flags().String("until", fmt.Sprintf("%dh", DEFAULT_TRACE_HOURS), "duration before tracing is disabled (0 never)")
+	viper.BindPFlag("enable.until", enableCmd.Flags().Lookup("until"))
+}
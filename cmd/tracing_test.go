@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnableTracingLevel(t *testing.T) {
+	_, err := EnableTracing(filepath.Join(t.TempDir(), "tracing.json"), "nobody", "everything", time.Hour)
+	require.NotNil(t, err)
+}
+
+func TestEnableTracingUnknownUser(t *testing.T) {
+	_, err := EnableTracing(filepath.Join(t.TempDir(), "tracing.json"), "no-such-user", DEFAULT_TRACE_LEVEL, time.Hour)
+	require.NotNil(t, err)
+}
+
+func TestTraceLevelFile(t *testing.T) {
+	dir := t.TempDir()
+	levelFile := filepath.Join(dir, "trace-levels")
+	defer viper.Set("tracing_level_file", "")
+	viper.Set("tracing_level_file", levelFile)
+	err := updateTracing(filepath.Join(dir, "tracing.json"), func(records map[string]*Tracing) error {
+		records["alice"] = &Tracing{Username: "alice", Source: TRACING_ENABLE, Level: "tests"}
+		records["bob"] = &Tracing{Username: "bob", Source: TRACING_SCAN}
+		return nil
+	})
+	require.Nil(t, err)
+	data, err := os.ReadFile(levelFile)
+	require.Nil(t, err)
+	require.Equal(t, "alice:::::::sieve_trace_level=tests\n", string(data))
+}
+
+func TestMakeTraceDir(t *testing.T) {
+	home := t.TempDir()
+	require.Nil(t, makeTraceDir(home, os.Getuid(), os.Getgid()))
+	require.True(t, IsDir(filepath.Join(home, TRACE_DIR)))
+	// an existing directory is reused
+	require.Nil(t, makeTraceDir(home, os.Getuid(), os.Getgid()))
+
+	// a symlink planted by the user is not followed
+	target := t.TempDir()
+	home = t.TempDir()
+	require.Nil(t, os.Symlink(target, filepath.Join(home, TRACE_DIR)))
+	require.NotNil(t, makeTraceDir(home, os.Getuid(), os.Getgid()))
+
+	home = t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(home, TRACE_DIR), []byte{}, 0600))
+	require.NotNil(t, makeTraceDir(home, os.Getuid(), os.Getgid()))
+}
+
+func TestExpireTracing(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tracing.json")
+	now := time.Now()
+	records := map[string]*Tracing{}
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		records[username] = &Tracing{Username: username, Dir: filepath.Join(dir, username, TRACE_DIR), Enabled: now.Add(-2 * time.Hour)}
+		require.Nil(t, os.MkdirAll(records[username].Dir, 0700))
+	}
+	records["alice"].Expires = now.Add(-time.Hour)
+	records["bob"].Expires = now.Add(time.Hour)
+	records["dave"].Expires = now.Add(-time.Hour)
+	err := updateTracing(filename, func(saved map[string]*Tracing) error {
+		for username, record := range records {
+			saved[username] = record
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	m := Monitor{
+		TracingFile: filename,
+		TraceFiles: map[string]*TraceFile{
+			"pending": {Username: "dave", Filename: "pending"},
+		},
+	}
+	m.expireTracing(context.Background(), now)
+
+	saved, err := LoadTracing(filename)
+	require.Nil(t, err)
+	require.NotContains(t, saved, "alice")
+	require.False(t, IsDir(records["alice"].Dir))
+	// unexpired, never expiring and pending users keep tracing
+	for _, username := range []string{"bob", "carol", "dave"} {
+		require.Contains(t, saved, username)
+		require.True(t, IsDir(records[username].Dir))
+	}
+}
+
+func TestExpireTracingScan(t *testing.T) {
+	dir := t.TempDir()
+	traceDir := filepath.Join(dir, "alice", TRACE_DIR)
+	require.Nil(t, os.MkdirAll(traceDir, 0700))
+	m := Monitor{
+		TracingFile:   filepath.Join(dir, "tracing.json"),
+		TracingMaxAge: time.Hour,
+		TraceFiles:    map[string]*TraceFile{},
+		traceDirs:     map[string]bool{},
+		Domain:        "example.org",
+	}
+	m.trackTraceDir("alice", traceDir)
+	require.True(t, m.traceDirs["alice"])
+	saved, err := LoadTracing(m.TracingFile)
+	require.Nil(t, err)
+	require.Equal(t, TRACING_SCAN, saved["alice"].Source)
+
+	m.expireTracing(context.Background(), time.Now())
+	require.True(t, IsDir(traceDir))
+
+	// a cancelled context keeps the notice from reaching sendmail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.expireTracing(ctx, time.Now().Add(2*time.Hour))
+	m.background.Wait()
+	require.False(t, IsDir(traceDir))
+	renamed, err := filepath.Glob(traceDir + ".expired-*")
+	require.Nil(t, err)
+	require.Len(t, renamed, 1)
+	require.False(t, m.traceDirs["alice"])
+	saved, err = LoadTracing(m.TracingFile)
+	require.Nil(t, err)
+	require.Empty(t, saved)
+}
+
+func TestTracingNotice(t *testing.T) {
+	record := Tracing{Username: "alice", Dir: "/home/alice/sieve_trace", Enabled: time.Now()}
+	text := tracingNotice(&record, "/home/alice/sieve_trace.expired-20261018-120000", 168*time.Hour)
+	require.Contains(t, text, "disabled")
+	require.Contains(t, text, "168h0m0s")
+	require.Contains(t, text, "sieve_trace.expired-20261018-120000")
+}
+
+func TestDisableTracingUnknown(t *testing.T) {
+	err := DisableTracing(filepath.Join(t.TempDir(), "tracing.json"), "alice")
+	require.NotNil(t, err)
+}
+
+func TestExpireTracingNoticeBackground(t *testing.T) {
+	release := make(chan struct{})
+	notices := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var payload WebhookPayload
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		notices <- payload.Event
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	traceDir := filepath.Join(dir, "alice", TRACE_DIR)
+	require.Nil(t, os.MkdirAll(traceDir, 0700))
+	m := Monitor{
+		TracingFile:   filepath.Join(dir, "tracing.json"),
+		TracingMaxAge: time.Hour,
+		TraceFiles:    map[string]*TraceFile{},
+		traceDirs:     map[string]bool{},
+		Domain:        "example.org",
+		Transport:     TRANSPORT_WEBHOOK,
+		webhook:       newTestWebhook(server.URL),
+	}
+	m.trackTraceDir("alice", traceDir)
+
+	// expiry returns while the notice is still being sent
+	m.expireTracing(context.Background(), time.Now().Add(2*time.Hour))
+	require.False(t, IsDir(traceDir))
+	close(release)
+	m.background.Wait()
+	require.Equal(t, "notice", <-notices)
+}
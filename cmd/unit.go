@@ -0,0 +1,99 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"os"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_WATCHDOG_SECONDS = 60
+
+var UNIT_TEMPLATE = template.Must(template.New("unit").Parse(`[Unit]
+Description=Sieve trace file processor
+Documentation=https://github.com/rstms/sieve-monitor
+After=network.target dovecot.service
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Executable}} --systemd --config {{.Config}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{- if gt .Watchdog 0}}
+WatchdogSec={{.Watchdog}}
+{{- end}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+type UnitConfig struct {
+	Executable string
+	Config     string
+	Watchdog   int
+}
+
+var unitCmd = &cobra.Command{
+	Use:   "unit",
+	Short: "output a systemd unit file",
+	Long: `
+Write a systemd service unit for running sieve-monitor in --systemd mode
+to stdout.  Install it as /etc/systemd/system/sieve-monitor.service.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		executable := viper.GetString("unit.executable")
+		if executable == "" {
+			var err error
+			executable, err = os.Executable()
+			cobra.CheckErr(err)
+		}
+		config := UnitConfig{
+			Executable: executable,
+			Config:     cfgFile,
+			Watchdog:   viper.GetInt("unit.watchdog"),
+		}
+		err := UNIT_TEMPLATE.Execute(os.Stdout, &config)
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unitCmd)
+	unitCmd.Flags().String("executable", "", "program path (default is the running executable)")
+	viper.BindPFlag("unit.executable", unitCmd.Flags().Lookup("executable"))
+	unitCmd.Flags().Int("watchdog", DEFAULT_WATCHDOG_SECONDS, "watchdog timeout seconds (0 disables)")
+	viper.BindPFlag("unit.watchdog", unitCmd.Flags().Lookup("watchdog"))
+}
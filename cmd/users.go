@@ -0,0 +1,204 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const PASSWD_FILE = "/etc/passwd"
+
+// HOME_DIR holds the home directories of users named in the config
+var HOME_DIR = "/home"
+
+// reasons a candidate user is included or excluded
+const USER_INCLUDED = "included"
+const USER_SKIP_USERS = "skip_users"
+const USER_UNDERSCORE = "underscore_prefix"
+const USER_MIN_UID = "below_min_uid"
+const USER_NO_HOME = "no_home_dir"
+const USER_NOT_LISTED = "not_in_usernames"
+const USER_DUPLICATE = "duplicate"
+
+// UserCandidate is a possible watched user with the reason for the decision
+type UserCandidate struct {
+	Username string `json:"username"`
+	Source   string `json:"source"`
+	UID      int    `json:"uid"`
+	Home     string `json:"home"`
+	Address  string `json:"address"`
+	TraceDir bool   `json:"trace_dir"`
+	Included bool   `json:"included"`
+	Reason   string `json:"reason"`
+}
+
+// UserCandidates lists the users named in the usernames setting followed by
+// the passwd entries; the passwd entries are only watched when none of the
+// named users qualify
+func (m *Monitor) UserCandidates(passwd string) ([]*UserCandidate, error) {
+	candidates := []*UserCandidate{}
+	listed := make(map[string]bool)
+	for _, username := range strings.Split(viper.GetString("usernames"), ",") {
+		username := strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		candidate := m.newCandidate(username, "config", -1, filepath.Join(HOME_DIR, username))
+		if candidate.Included {
+			listed[username] = true
+		}
+		candidates = append(candidates, candidate)
+	}
+	configured := len(listed) > 0
+
+	file, err := os.Open(passwd)
+	if err != nil {
+		if configured {
+			return candidates, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 6 {
+			continue
+		}
+		username := fields[0]
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid for %s: %v", username, err)
+		}
+		candidate := m.newCandidate(username, "passwd", uid, fields[5])
+		if configured && candidate.Included {
+			candidate.Included = false
+			candidate.Reason = USER_NOT_LISTED
+			if listed[username] {
+				// the user is already watched from the config entry
+				candidate.Reason = USER_DUPLICATE
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// newCandidate decides whether a user is watched; a negative uid means the
+// user was named in the config and the min_uid rule does not apply
+func (m *Monitor) newCandidate(username, source string, uid int, home string) *UserCandidate {
+	candidate := UserCandidate{
+		Username: username,
+		Source:   source,
+		UID:      uid,
+		Home:     home,
+		Address:  username + "@" + m.Domain,
+		TraceDir: IsDir(filepath.Join(home, TRACE_DIR)),
+	}
+	switch {
+	case slices.Contains(m.SkipUsers, username):
+		candidate.Reason = USER_SKIP_USERS
+	case strings.HasPrefix(username, "_"):
+		candidate.Reason = USER_UNDERSCORE
+	case uid >= 0 && uid < m.MinUID:
+		candidate.Reason = USER_MIN_UID
+	case !IsDir(home):
+		candidate.Reason = USER_NO_HOME
+	default:
+		candidate.Included = true
+		candidate.Reason = USER_INCLUDED
+	}
+	return &candidate
+}
+
+func writeUserTable(w io.Writer, candidates []*UserCandidate) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USER\tSOURCE\tUID\tHOME\tADDRESS\tTRACE_DIR\tREASON")
+	for _, c := range candidates {
+		uid := "-"
+		if c.UID >= 0 {
+			uid = strconv.Itoa(c.UID)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", c.Username, c.Source, uid, c.Home, c.Address, c.TraceDir, c.Reason)
+	}
+	return table.Flush()
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "list watched users",
+	Long: `
+List every candidate user from the usernames setting and /etc/passwd with
+its home directory, mail address, whether a sieve_trace directory exists,
+and the reason it is watched or skipped.  --included limits the list to
+the users the daemon watches.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		monitor := NewMonitor()
+		candidates, err := monitor.UserCandidates(PASSWD_FILE)
+		cobra.CheckErr(err)
+		if viper.GetBool("users.included") {
+			candidates = slices.DeleteFunc(candidates, func(c *UserCandidate) bool { return !c.Included })
+		}
+		switch viper.GetString("users.format") {
+		case "table", "":
+			err = writeUserTable(os.Stdout, candidates)
+			cobra.CheckErr(err)
+		case "json":
+			fmt.Println(FormatJSON(candidates))
+		default:
+			cobra.CheckErr(fmt.Errorf("unknown format: %s", viper.GetString("users.format")))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(usersCmd)
+	usersCmd.Flags().String("format", "table", "output format (table, json)")
+	viper.BindPFlag("users.format", usersCmd.Flags().Lookup("format"))
+	usersCmd.Flags().Bool("included", false, "list only watched users")
+	viper.BindPFlag("users.included", usersCmd.Flags().Lookup("included"))
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePasswd(t *testing.T, dir string) string {
+	alice := filepath.Join(dir, "alice")
+	require.Nil(t, os.MkdirAll(filepath.Join(alice, TRACE_DIR), 0700))
+	relay := filepath.Join(dir, "relay")
+	require.Nil(t, os.Mkdir(relay, 0700))
+	passwd := filepath.Join(dir, "passwd")
+	data := fmt.Sprintf(`root:x:0:0:root:/root:/bin/sh
+alice:x:1001:1001::%s:/bin/sh
+bob:x:1002:1002::%s:/bin/sh
+relay:x:1003:1003::%s:/bin/sh
+_sieve:x:1004:1004::%s:/bin/sh
+`, alice, filepath.Join(dir, "bob"), relay, alice)
+	require.Nil(t, os.WriteFile(passwd, []byte(data), 0600))
+	return passwd
+}
+
+func TestUserCandidates(t *testing.T) {
+	passwd := writePasswd(t, t.TempDir())
+	m := Monitor{MinUID: 1000, SkipUsers: []string{"relay"}, Domain: "example.org"}
+	candidates, err := m.UserCandidates(passwd)
+	require.Nil(t, err)
+	reasons := make(map[string]string)
+	for _, c := range candidates {
+		reasons[c.Username] = c.Reason
+	}
+	require.Equal(t, map[string]string{
+		"root":   USER_MIN_UID,
+		"alice":  USER_INCLUDED,
+		"bob":    USER_NO_HOME,
+		"relay":  USER_SKIP_USERS,
+		"_sieve": USER_UNDERSCORE,
+	}, reasons)
+	require.True(t, candidates[1].Included)
+	require.True(t, candidates[1].TraceDir)
+	require.Equal(t, "alice@example.org", candidates[1].Address)
+
+	var buf bytes.Buffer
+	require.Nil(t, writeUserTable(&buf, candidates))
+	require.Contains(t, buf.String(), "alice@example.org")
+}
+
+func TestUserCandidatesConfigured(t *testing.T) {
+	passwd := writePasswd(t, t.TempDir())
+	viper.Set("usernames", "nobody-here")
+	defer viper.Set("usernames", "")
+	m := Monitor{MinUID: 1000, Domain: "example.org"}
+	candidates, err := m.UserCandidates(passwd)
+	require.Nil(t, err)
+	// a named user without a home falls back to passwd
+	require.Equal(t, "config", candidates[0].Source)
+	require.Equal(t, USER_NO_HOME, candidates[0].Reason)
+	require.Equal(t, USER_INCLUDED, candidates[2].Reason)
+}
+
+func TestUserCandidatesDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	passwd := writePasswd(t, dir)
+	defer func(home string) { HOME_DIR = home }(HOME_DIR)
+	HOME_DIR = dir
+	viper.Set("usernames", "alice")
+	defer viper.Set("usernames", "")
+	m := Monitor{MinUID: 1000, Domain: "example.org"}
+	candidates, err := m.UserCandidates(passwd)
+	require.Nil(t, err)
+	require.Equal(t, "config", candidates[0].Source)
+	require.True(t, candidates[0].Included)
+	reasons := make(map[string]string)
+	for _, candidate := range candidates[1:] {
+		require.False(t, candidate.Included)
+		reasons[candidate.Username] = candidate.Reason
+	}
+	require.Equal(t, USER_DUPLICATE, reasons["alice"])
+	require.Equal(t, USER_NOT_LISTED, reasons["relay"])
+}
@@ -0,0 +1,413 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DEFAULT_HTTP_LIST_LIMIT = 100
+const DEFAULT_HTTP_TRUSTED_PROXIES = "127.0.0.1,::1"
+
+var TRACE_PATTERN_INCLUDE = regexp.MustCompile(`^include: start script '([^']+)'`)
+
+// TraceNode is a script in the include tree, with the scripts it included
+// attached to the include steps
+type TraceNode struct {
+	Name  string
+	Steps []*TraceNodeStep
+}
+
+type TraceNodeStep struct {
+	*TraceStep
+	Include *TraceNode
+}
+
+// traceTree arranges the scripts of a trace by include; each include step
+// takes the next unclaimed script of that name, and scripts no include
+// claims are listed at the top level
+func traceTree(trace *Trace) []*TraceNode {
+	claimed := make([]bool, len(trace.Scripts))
+	var build func(index int) *TraceNode
+	build = func(index int) *TraceNode {
+		claimed[index] = true
+		script := trace.Scripts[index]
+		node := TraceNode{Name: script.Name}
+		for _, step := range script.Steps {
+			nodeStep := TraceNodeStep{TraceStep: step}
+			match := TRACE_PATTERN_INCLUDE.FindStringSubmatch(step.Command)
+			if match != nil {
+				for i := index + 1; i < len(trace.Scripts); i++ {
+					if !claimed[i] && trace.Scripts[i].Name == match[1] {
+						nodeStep.Include = build(i)
+						break
+					}
+				}
+			}
+			node.Steps = append(node.Steps, &nodeStep)
+		}
+		return &node
+	}
+	roots := []*TraceNode{}
+	for i := range trace.Scripts {
+		if !claimed[i] {
+			roots = append(roots, build(i))
+		}
+	}
+	return roots
+}
+
+// WebServer serves the trace history to authenticated users; admins see
+// every user's traces and everyone else only their own
+type WebServer struct {
+	History        *History
+	Htpasswd       map[string]string
+	ProxyHeader    string
+	TrustedProxies []netip.Prefix
+	Admins         []string
+}
+
+// NewWebServer returns a server authenticating with the htpasswd file, or
+// trusting the user named in proxyHeader when it is set and the request
+// comes from one of trustedProxies
+func NewWebServer(history *History, htpasswdFile, proxyHeader string, trustedProxies, admins []string) (*WebServer, error) {
+	server := WebServer{History: history, ProxyHeader: proxyHeader, Admins: admins}
+	switch {
+	case proxyHeader != "":
+		prefixes, err := parsePrefixes(trustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http_trusted_proxies: %v", err)
+		}
+		if len(prefixes) == 0 {
+			return nil, errors.New("http_proxy_header requires http_trusted_proxies")
+		}
+		server.TrustedProxies = prefixes
+	case htpasswdFile != "":
+		htpasswd, err := loadHtpasswd(htpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		server.Htpasswd = htpasswd
+	default:
+		return nil, errors.New("http_htpasswd or http_proxy_header is required")
+	}
+	return &server, nil
+}
+
+// parsePrefixes parses addresses and CIDR networks, skipping empty values
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			continue
+		case strings.Contains(value, "/"):
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		default:
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// trustedProxy returns true if the request comes from a trusted proxy
+func (s *WebServer) trustedProxy(r *http.Request) bool {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := remote.Addr().Unmap()
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHtpasswd reads user:hash lines, rejecting hash formats that
+// checkPassword does not accept
+func loadHtpasswd(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid htpasswd line for %s", username)
+		}
+		if !supportedHash(hash) {
+			// MD5 ($apr1$), crypt and plain text entries would never match
+			return nil, fmt.Errorf("unsupported htpasswd hash for %s, use bcrypt (htpasswd -B) or {SHA}", username)
+		}
+		users[username] = hash
+	}
+	return users, scanner.Err()
+}
+
+// supportedHash returns true for the formats checkPassword accepts
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// checkPassword accepts the bcrypt and {SHA} htpasswd formats
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(encoded)) == 1
+	}
+	return false
+}
+
+// authenticate returns the requesting user, or an empty string
+func (s *WebServer) authenticate(r *http.Request) string {
+	if s.ProxyHeader != "" {
+		if !s.trustedProxy(r) {
+			slog.Warn("web: proxy header from untrusted address", "address", r.RemoteAddr)
+			return ""
+		}
+		return r.Header.Get(s.ProxyHeader)
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	hash, found := s.Htpasswd[username]
+	if !found || !checkPassword(hash, password) {
+		return ""
+	}
+	return username
+}
+
+type webUser struct{}
+
+func (s *WebServer) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := s.authenticate(r)
+		if username == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sieve-monitor"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), webUser{}, username)))
+	}
+}
+
+func (s *WebServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.requireUser(s.index))
+	mux.HandleFunc("GET /trace/{id}", s.requireUser(s.trace))
+	return mux
+}
+
+func (s *WebServer) index(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(webUser{}).(string)
+	admin := slices.Contains(s.Admins, username)
+	query := HistoryQuery{
+		Username: username,
+		Sender:   r.URL.Query().Get("sender"),
+		Limit:    DEFAULT_HTTP_LIST_LIMIT,
+	}
+	if admin {
+		query.Username = r.URL.Query().Get("user")
+	}
+	records, err := s.History.Search(&query)
+	if err != nil {
+		slog.Error("web: history search failed", "error", err)
+		http.Error(w, "history unavailable", http.StatusInternalServerError)
+		return
+	}
+	s.render(w, "index", map[string]any{"User": username, "Admin": admin, "Query": query, "Records": records})
+}
+
+func (s *WebServer) trace(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(webUser{}).(string)
+	record, err := s.History.Get(r.PathValue("id"))
+	if err != nil || record == nil || record.Trace == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if record.Username != username && !slices.Contains(s.Admins, username) {
+		http.NotFound(w, r)
+		return
+	}
+	s.render(w, "trace", map[string]any{"User": username, "Record": record, "Tree": traceTree(record.Trace)})
+}
+
+func (s *WebServer) render(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := WEB_TEMPLATES.ExecuteTemplate(w, name, data)
+	if err != nil {
+		slog.Error("web: render failed", "template", name, "error", err)
+	}
+}
+
+// startWeb serves the web UI on the http_listen address until ctx is done
+func (m *Monitor) startWeb(ctx context.Context) error {
+	if m.HTTPListen == "" {
+		return nil
+	}
+	if m.history == nil {
+		return errors.New("the web UI requires history_file")
+	}
+	web, err := NewWebServer(m.history, m.HTTPHtpasswd, m.HTTPProxyHeader, m.HTTPTrustedProxies, m.HTTPAdmins)
+	if err != nil {
+		return err
+	}
+	// listen before returning, so a bad address or port in use stops startup
+	listener, err := net.Listen("tcp", m.HTTPListen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           web.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("web: listening", "address", listener.Addr().String())
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("web: server failed", "address", m.HTTPListen, "error", err)
+		}
+	}()
+	return nil
+}
+
+var WEB_TEMPLATES = template.Must(template.New("web").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Sieve Traces</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+details { margin-left: 1.2em; }
+.step { font-family: monospace; }
+.matched { color: #060; font-weight: bold; }
+.not-matched { color: #888; }
+.detail { font-family: monospace; color: #555; margin-left: 2em; }
+pre { background: #f4f4f4; padding: 1em; }
+</style></head><body>
+<p><a href="/">traces</a> &middot; {{.User}}</p>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<form method="get">
+{{if .Admin}}user <input name="user" value="{{.Query.Username}}">{{end}}
+sender <input name="sender" value="{{.Query.Sender}}" placeholder="*@example.com">
+<input type="submit" value="search">
+</form>
+<table>
+<tr><th>time</th><th>user</th><th>sender</th><th>subject</th><th>outcome</th><th>actions</th></tr>
+{{range .Records}}<tr>
+<td><a href="/trace/{{.ID}}">{{timestamp .Time}}</a></td>
+<td>{{.Username}}</td><td>{{.Sender}}</td><td>{{.Subject}}</td>
+<td>{{.Outcome}} {{.Reason}}</td>
+<td>{{range .Actions}}{{.}}<br>{{end}}</td>
+</tr>{{else}}<tr><td colspan="6">no traces</td></tr>{{end}}
+</table>
+</body></html>
+{{end}}
+
+{{define "node"}}<details open><summary>script <b>{{.Name}}</b></summary>
+{{range .Steps}}<div class="step {{if eq .Result "matched"}}matched{{else if .Result}}not-matched{{end}}">{{.Line}}: {{.Command}}{{if .Result}} &rarr; {{.Result}}{{end}}</div>
+{{if .Details}}<details><summary>details</summary>{{range .Details}}<div class="detail">{{.}}</div>{{end}}</details>{{end}}
+{{if .Include}}{{template "node" .Include}}{{end}}
+{{end}}</details>
+{{end}}
+
+{{define "trace"}}{{template "header" .}}
+{{with .Record}}
+<h2>{{if .Subject}}{{.Subject}}{{else}}{{.Trace.Kind}}{{end}}</h2>
+<table>
+<tr><th>time</th><td>{{timestamp .Time}}</td></tr>
+<tr><th>user</th><td>{{.Username}}</td></tr>
+<tr><th>sender</th><td>{{.Sender}}</td></tr>
+<tr><th>recipient</th><td>{{.Recipient}}</td></tr>
+<tr><th>message-id</th><td>{{.MessageID}}</td></tr>
+<tr><th>session</th><td>{{.Trace.SessionID}}</td></tr>
+<tr><th>outcome</th><td>{{.Outcome}} {{.Reason}}</td></tr>
+</table>
+<h3>actions</h3>
+<ul>{{range .Actions}}<li>{{.}}</li>{{else}}<li>none recorded</li>{{end}}</ul>
+{{end}}
+<h3>scripts</h3>
+{{range .Tree}}{{template "node" .}}{{end}}
+<details><summary>raw trace</summary><pre>{{.Record.Raw}}</pre></details>
+</body></html>
+{{end}}
+`))
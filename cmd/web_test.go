@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTraceTree(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	tree := traceTree(trace)
+	require.Len(t, tree, 1)
+	require.Equal(t, "new-mail", tree[0].Name)
+	require.NotNil(t, tree[0].Steps[0].Include)
+	require.Equal(t, "ignore-daemons", tree[0].Steps[0].Include.Name)
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	require.True(t, checkPassword(string(hash), "secret"))
+	require.False(t, checkPassword(string(hash), "wrong"))
+	// htpasswd -nbs alice secret
+	require.True(t, checkPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"))
+	require.False(t, checkPassword("secret", "secret"))
+}
+
+func TestLoadHtpasswdUnsupported(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.Nil(t, os.WriteFile(htpasswd, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+	users, err := loadHtpasswd(htpasswd)
+	require.Nil(t, err)
+	require.Contains(t, users, "alice")
+
+	// MD5, crypt and plain text entries
+	for _, hash := range []string{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "rqXcS3xJ6kDJI", "secret"} {
+		require.Nil(t, os.WriteFile(htpasswd, []byte("bob:"+hash+"\n"), 0600))
+		_, err = loadHtpasswd(htpasswd)
+		require.ErrorContains(t, err, "unsupported htpasswd hash for bob")
+	}
+}
+
+func TestWebServer(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHistory(filepath.Join(dir, "history.db"))
+	mine := addHistory(t, h, "alice", "testdata/actions.trace", time.Now())
+	other := addHistory(t, h, "bob", "testdata/thread.trace", time.Now())
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	htpasswd := filepath.Join(dir, "htpasswd")
+	require.Nil(t, os.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\n"), 0600))
+	web, err := NewWebServer(h, htpasswd, "", nil, nil)
+	require.Nil(t, err)
+	server := httptest.NewServer(web.Handler())
+	defer server.Close()
+
+	get := func(path, password string) (int, string) {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		require.Nil(t, err)
+		request.SetBasicAuth("alice", password)
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(t, err)
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		require.Nil(t, err)
+		return response.StatusCode, string(body)
+	}
+	status, _ := get("/", "wrong")
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, body := get("/", "secret")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, mine.ID)
+	require.NotContains(t, body, other.ID)
+	status, body = get("/trace/"+mine.ID, "secret")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "script <b>new-mail</b>")
+	require.Contains(t, body, "store message in mailbox `Lists&#39;")
+	status, _ = get("/trace/"+other.ID, "secret")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestWebServerProxyHeader(t *testing.T) {
+	h := NewHistory(filepath.Join(t.TempDir(), "history.db"))
+	other := addHistory(t, h, "bob", "testdata/thread.trace", time.Now())
+	web, err := NewWebServer(h, "", "X-Remote-User", []string{"127.0.0.1", "10.1.0.0/16"}, []string{"admin"})
+	require.Nil(t, err)
+	get := func(remoteAddr string) int {
+		request := httptest.NewRequest("GET", "/trace/"+other.ID, nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-Remote-User", "admin")
+		recorder := httptest.NewRecorder()
+		web.Handler().ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	require.Equal(t, http.StatusOK, get("127.0.0.1:40000"))
+	require.Equal(t, http.StatusOK, get("10.1.2.3:40000"))
+	// the header is ignored from anyone but the proxy
+	require.Equal(t, http.StatusUnauthorized, get("192.0.2.1:40000"))
+
+	_, err = NewWebServer(h, "", "", nil, nil)
+	require.NotNil(t, err)
+	_, err = NewWebServer(h, "", "X-Remote-User", nil, nil)
+	require.NotNil(t, err)
+	_, err = NewWebServer(h, "", "X-Remote-User", []string{"proxy.example.org"}, nil)
+	require.NotNil(t, err)
+}
+
+func TestStartWebListenFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := Monitor{
+		HTTPListen:         listener.Addr().String(),
+		HTTPProxyHeader:    "X-Remote-User",
+		HTTPTrustedProxies: []string{"127.0.0.1"},
+		history:            NewHistory(filepath.Join(t.TempDir(), "history.db")),
+	}
+	require.NotNil(t, m.startWeb(ctx))
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const TRANSPORT_SENDMAIL = "sendmail"
+const TRANSPORT_WEBHOOK = "webhook"
+const DEFAULT_TRANSPORT = TRANSPORT_SENDMAIL
+
+const DEFAULT_WEBHOOK_TIMEOUT_SECONDS = 10
+const DEFAULT_WEBHOOK_RETRY_SECONDS = 30
+
+// WEBHOOK_RETRY_MAX caps the doubling delay between attempts at a trace
+const WEBHOOK_RETRY_MAX = time.Hour
+
+const WEBHOOK_SIGNATURE_HEADER = "X-Sieve-Monitor-Signature"
+const WEBHOOK_TIMESTAMP_HEADER = "X-Sieve-Monitor-Timestamp"
+
+// WebhookPayload is the JSON body posted for each event: a forwarded
+// trace, a rate limit digest or a notice
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Address   string    `json:"address"`
+	Kind      string    `json:"kind"`
+	SessionID string    `json:"session_id,omitempty"`
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Scripts   []string  `json:"scripts,omitempty"`
+	Actions   []string  `json:"actions,omitempty"`
+	Summary   string    `json:"summary"`
+	Raw       string    `json:"raw,omitempty"`
+	Link      string    `json:"link,omitempty"`
+	MonitorID string    `json:"monitor_id"`
+}
+
+// WebhookRejected is a response that retrying will not change
+type WebhookRejected struct {
+	Status int
+}
+
+func (e *WebhookRejected) Error() string {
+	return fmt.Sprintf("webhook rejected request: %s", http.StatusText(e.Status))
+}
+
+// Webhook posts trace events to a URL, signed with HMAC-SHA256 over the
+// timestamp header, a dot and the body when a secret is configured
+type Webhook struct {
+	URL        string
+	Secret     string
+	LinkURL    string
+	IncludeRaw bool // ignored when LinkURL is set
+	RetryDelay time.Duration
+	client     *http.Client
+}
+
+func NewWebhook() (*Webhook, error) {
+	target := viper.GetString("webhook_url")
+	if target == "" {
+		return nil, errors.New("webhook_url is required for the webhook transport")
+	}
+	_, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_url: %v", err)
+	}
+	_, err = url.Parse(viper.GetString("webhook_link_url"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_link_url: %v", err)
+	}
+	webhook := Webhook{
+		URL:        target,
+		Secret:     viper.GetString("webhook_secret"),
+		LinkURL:    viper.GetString("webhook_link_url"),
+		IncludeRaw: viper.GetBool("webhook_include_raw"),
+		RetryDelay: time.Duration(viper.GetInt64("webhook_retry_seconds")) * time.Second,
+		client:     &http.Client{Timeout: time.Duration(viper.GetInt64("webhook_timeout_seconds")) * time.Second},
+	}
+	return &webhook, nil
+}
+
+// Payload returns the event for a trace
+func (w *Webhook) Payload(username, domain string, trace *Trace, monitorID string) (*WebhookPayload, error) {
+	var summary bytes.Buffer
+	writeTraceSummary(&summary, trace)
+	record := NewHistoryRecord(username, trace, nil, HISTORY_FORWARDED, "")
+	payload := WebhookPayload{
+		Event:     "trace",
+		Time:      time.Now(),
+		User:      username,
+		Address:   username + "@" + domain,
+		Kind:      trace.Kind,
+		SessionID: trace.SessionID,
+		Sender:    trace.Sender,
+		Recipient: record.Recipient,
+		MessageID: trace.MessageID,
+		Subject:   trace.Subject,
+		Scripts:   record.Scripts,
+		Actions:   trace.Actions,
+		Summary:   summary.String(),
+		MonitorID: monitorID,
+	}
+	if w.includeRaw() {
+		raw, err := os.ReadFile(trace.Filename)
+		if err != nil {
+			return nil, err
+		}
+		payload.Raw = string(raw)
+	}
+	if w.LinkURL != "" {
+		// the web UI lists the user's traces from this sender
+		link, err := url.Parse(w.LinkURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook_link_url: %v", err)
+		}
+		query := link.Query()
+		query.Set("user", username)
+		query.Set("sender", trace.Sender)
+		link.RawQuery = query.Encode()
+		payload.Link = link.String()
+	}
+	return &payload, nil
+}
+
+// includeRaw returns true if events carry the raw trace; a link to the web
+// UI replaces it, keeping message headers out of third party tools
+func (w *Webhook) includeRaw() bool {
+	return w.IncludeRaw && w.LinkURL == ""
+}
+
+// Sign returns the signature header value for a request body
+func (w *Webhook) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts the trace event
+func (w *Webhook) Send(ctx context.Context, username, domain string, trace *Trace, monitorID string) error {
+	payload, err := w.Payload(username, domain, trace, monitorID)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = w.sendPayload(ctx, payload)
+	if err != nil {
+		return err
+	}
+	slog.Info("sent webhook",
+		LOG_USER, username,
+		"url", w.URL,
+		LOG_FILE, trace.Filename,
+		"session", trace.SessionID,
+		LOG_DURATION, time.Since(start),
+	)
+	return nil
+}
+
+// SendDigest posts a digest event for the traces the rate limit held
+func (w *Webhook) SendDigest(ctx context.Context, username, domain string, filenames []string) error {
+	payload := WebhookPayload{
+		Event:     "digest",
+		Time:      time.Now(),
+		User:      username,
+		Address:   username + "@" + domain,
+		Kind:      "digest",
+		Summary:   digestSummary(username, domain, filenames),
+		MonitorID: NewMonitorID(),
+	}
+	if w.includeRaw() {
+		var raw strings.Builder
+		for _, filename := range digestTraces(filenames) {
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			raw.Write(data)
+		}
+		payload.Raw = raw.String()
+	}
+	start := time.Now()
+	err := w.sendPayload(ctx, &payload)
+	if err != nil {
+		return err
+	}
+	slog.Info("sent webhook digest", LOG_USER, username, "url", w.URL, "count", len(filenames), LOG_DURATION, time.Since(start))
+	return nil
+}
+
+// SendNotice posts a notice event, such as tracing being disabled
+func (w *Webhook) SendNotice(ctx context.Context, username, domain, subject, text string) error {
+	payload := WebhookPayload{
+		Event:     "notice",
+		Time:      time.Now(),
+		User:      username,
+		Address:   username + "@" + domain,
+		Kind:      "notice",
+		Subject:   subject,
+		Summary:   text,
+		MonitorID: NewMonitorID(),
+	}
+	start := time.Now()
+	err := w.sendPayload(ctx, &payload)
+	if err != nil {
+		return err
+	}
+	slog.Info("sent webhook notice", LOG_USER, username, "url", w.URL, "subject", subject, LOG_DURATION, time.Since(start))
+	return nil
+}
+
+// sendPayload posts an event once; a failed trace is kept and retried on
+// a later scan, so a slow endpoint does not hold up a delivery worker
+func (w *Webhook) sendPayload(ctx context.Context, payload *WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return w.post(ctx, body)
+}
+
+// retryDelay returns how long to wait before the next attempt at a trace
+// that has failed failures times
+func (w *Webhook) retryDelay(failures int) time.Duration {
+	delay := w.RetryDelay
+	for i := 1; i < failures && delay < WEBHOOK_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	return min(delay, WEBHOOK_RETRY_MAX)
+}
+
+func (w *Webhook) post(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "sieve-monitor/"+Version)
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+		request.Header.Set(WEBHOOK_SIGNATURE_HEADER, w.Sign(timestamp, body))
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("webhook failed: %s", response.Status)
+	}
+	return &WebhookRejected{Status: response.StatusCode}
+}
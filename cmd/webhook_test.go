@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:        url,
+		Secret:     "s3cret",
+		IncludeRaw: true,
+		RetryDelay: time.Second,
+		client:     &http.Client{Timeout: time.Second},
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	var attempts atomic.Int32
+	var payload WebhookPayload
+	webhook := newTestWebhook("")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		timestamp := r.Header.Get(WEBHOOK_TIMESTAMP_HEADER)
+		require.Equal(t, webhook.Sign(timestamp, body), r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+		attempts.Add(1)
+		require.Nil(t, json.Unmarshal(body, &payload))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	webhook.URL = server.URL
+
+	trace, err := ParseTrace("testdata/actions.trace")
+	require.Nil(t, err)
+	err = webhook.Send(context.Background(), "alice", "example.org", trace, NewMonitorID())
+	require.Nil(t, err)
+	require.Equal(t, int32(1), attempts.Load())
+	require.Equal(t, "alice@example.org", payload.Address)
+	require.Equal(t, "news@lists.example.org", payload.Sender)
+	require.Equal(t, []string{"store message in mailbox `Lists'"}, payload.Actions)
+	require.Contains(t, payload.Summary, "script new-mail:")
+	require.Contains(t, payload.Raw, "fileinto action")
+}
+
+func TestWebhookRejected(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	err = newTestWebhook(server.URL).Send(context.Background(), "alice", "example.org", trace, NewMonitorID())
+	var rejected *WebhookRejected
+	require.ErrorAs(t, err, &rejected)
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWebhookFailed(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	webhook := newTestWebhook(server.URL)
+	webhook.LinkURL = "https://sieve.example.org/"
+	payload, err := webhook.Payload("alice", "example.org", trace, NewMonitorID())
+	require.Nil(t, err)
+	require.Equal(t, "https://sieve.example.org/?sender=email_feedback_handler%40bbcsreturn.convio.net&user=alice", payload.Link)
+	require.Empty(t, payload.Raw)
+	err = webhook.Send(context.Background(), "alice", "example.org", trace, NewMonitorID())
+	require.NotNil(t, err)
+	// retrying is left to the monitor, so the worker is not held up
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	webhook := newTestWebhook("")
+	require.Equal(t, time.Second, webhook.retryDelay(1))
+	require.Equal(t, 4*time.Second, webhook.retryDelay(3))
+	require.Equal(t, WEBHOOK_RETRY_MAX, webhook.retryDelay(100))
+}
+
+func TestWebhookDeliverOutcome(t *testing.T) {
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	m := Monitor{Domain: "example.org", Transport: TRANSPORT_WEBHOOK, webhook: newTestWebhook(server.URL)}
+	file := TraceFile{Username: "alice", Filename: "testdata/delivery.trace"}
+	require.Equal(t, HISTORY_FORWARDED, file.deliver(context.Background(), &m))
+
+	status = http.StatusBadRequest
+	require.Equal(t, HISTORY_REJECTED, file.deliver(context.Background(), &m))
+	require.Equal(t, "webhook_rejected", file.reason)
+
+	status = http.StatusBadGateway
+	require.Equal(t, "", file.deliver(context.Background(), &m))
+}
+
+func TestWebhookDigestAndNotice(t *testing.T) {
+	payloads := make(chan WebhookPayload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		payloads <- payload
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	m := Monitor{Domain: "example.org", Transport: TRANSPORT_WEBHOOK, webhook: newTestWebhook(server.URL)}
+
+	err := m.sendDigest(context.Background(), "alice", []string{"testdata/delivery.trace", "testdata/actions.trace"})
+	require.Nil(t, err)
+	payload := <-payloads
+	require.Equal(t, "digest", payload.Event)
+	require.Equal(t, "alice@example.org", payload.Address)
+	require.Contains(t, payload.Summary, "2 traces were suppressed")
+	require.Contains(t, payload.Summary, "actions.trace")
+	require.Contains(t, payload.Raw, "fileinto action")
+
+	err = m.sendNotice(context.Background(), "alice", "Sieve Trace: tracing disabled", "tracing has been disabled")
+	require.Nil(t, err)
+	payload = <-payloads
+	require.Equal(t, "notice", payload.Event)
+	require.Equal(t, "Sieve Trace: tracing disabled", payload.Subject)
+	require.Equal(t, "tracing has been disabled", payload.Summary)
+}
+
+func TestWebhookRejectedJournal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal.log"))
+	require.Nil(t, err)
+	defer journal.Close()
+	m := Monitor{Domain: "example.org", Transport: TRANSPORT_WEBHOOK, webhook: newTestWebhook(server.URL), journal: journal}
+	file := TraceFile{Username: "alice", Filename: "testdata/delivery.trace"}
+	require.Equal(t, HISTORY_REJECTED, file.deliver(context.Background(), &m))
+	key, err := FileIdentity(file.Filename)
+	require.Nil(t, err)
+	require.Equal(t, JOURNAL_FAILED, journal.State(key))
+}
+
+func TestWebhookLinkQuery(t *testing.T) {
+	trace, err := ParseTrace("testdata/delivery.trace")
+	require.Nil(t, err)
+	webhook := newTestWebhook("")
+	webhook.LinkURL = "https://sieve.example.org/traces?view=list"
+	payload, err := webhook.Payload("alice", "example.org", trace, NewMonitorID())
+	require.Nil(t, err)
+	require.Equal(t, "https://sieve.example.org/traces?sender=email_feedback_handler%40bbcsreturn.convio.net&user=alice&view=list", payload.Link)
+}